@@ -0,0 +1,219 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/client"
+	etcdstorage "k8s.io/kubernetes/pkg/storage/etcd"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/golang/glog"
+)
+
+// leaseInfo is what a backend knows about a lease.
+type leaseInfo struct {
+	holder string
+	expiry time.Time
+}
+
+// leaseBackend stores the master leases.
+type leaseBackend interface {
+	// acquireOrRenew either races to acquire the lease of key for whoami, or renews it if whoami already holds it.
+	// returns the lease, held by whoami if we are the master, and an error if one occurs.
+	acquireOrRenew(key, whoami string, ttl uint64) (leaseInfo, error)
+	// release gives up the lease of key if whoami holds it, so another master can take over without
+	// waiting for it to expire.  returns true if whoami held the lease.
+	release(key, whoami string) (bool, error)
+}
+
+// etcdLeases stores each lease in an etcd key, expired by etcd using compare-and-swap.
+type etcdLeases struct {
+	client *etcd.Client
+}
+
+// TODO: use the master election utility once it is merged in.
+func (e *etcdLeases) acquireOrRenew(key, whoami string, ttl uint64) (leaseInfo, error) {
+	result, err := e.client.Get(key, false, false)
+	if err != nil {
+		if etcdstorage.IsEtcdNotFound(err) {
+			// there is no current master, try to become master, create will fail if the key already exists
+			result, err := e.client.Create(key, whoami, ttl)
+			if err != nil {
+				return leaseInfo{}, err
+			}
+			return nodeLease(result.Node), nil
+		}
+		return leaseInfo{}, err
+	}
+	if result.Node.Value == whoami {
+		glog.Infof("key %s already exists, we are the master (%s)", key, result.Node.Value)
+		// we extend our lease @ 1/2 of the existing TTL, this ensures the master doesn't flap around
+		if result.Node.Expiration.Sub(time.Now()) < time.Duration(ttl/2)*time.Second {
+			result, err = e.client.CompareAndSwap(key, whoami, ttl, whoami, result.Node.ModifiedIndex)
+			if err != nil {
+				return leaseInfo{}, err
+			}
+		}
+		return nodeLease(result.Node), nil
+	}
+	glog.Infof("key %s already exists, the master is %s, sleeping.", key, result.Node.Value)
+	return nodeLease(result.Node), nil
+}
+
+// nodeLease returns the lease stored in an etcd node.
+func nodeLease(node *etcd.Node) leaseInfo {
+	lease := leaseInfo{holder: node.Value}
+	if node.Expiration != nil {
+		lease.expiry = *node.Expiration
+	}
+	return lease
+}
+
+func (e *etcdLeases) release(key, whoami string) (bool, error) {
+	// compare-and-delete, so we never delete the lease of another master
+	_, err := e.client.CompareAndDelete(key, whoami, 0)
+	if etcdstorage.IsEtcdNotFound(err) || etcdstorage.IsEtcdTestFailed(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// leaseAnnotation is the annotation of the lock endpoints holding the leaseRecord.
+const leaseAnnotation = "podmaster/lease"
+
+// leaseRecord is the lease held by a master.
+type leaseRecord struct {
+	HolderIdentity string    `json:"holderIdentity"`
+	TTLSeconds     uint64    `json:"ttlSeconds"`
+	RenewTime      time.Time `json:"renewTime"`
+}
+
+// kubernetesLeases stores each lease in an annotation of an endpoints object named after the key, so
+// podmaster only needs access to the apiserver.  Nobody expires the annotation, a lease expires when
+// it hasn't changed for its ttl, as measured on our clock to be immune to clock skew between masters.
+// Updates carry the resourceVersion of the endpoints we read, so only one master can win a race.
+type kubernetesLeases struct {
+	client    client.EndpointsNamespacer
+	namespace string
+
+	lock sync.Mutex
+	// observed is the last annotation seen for each key, and observedTime when it was first seen.
+	observed     map[string]string
+	observedTime map[string]time.Time
+}
+
+func newKubernetesLeases(kubeClient client.EndpointsNamespacer, namespace string) *kubernetesLeases {
+	return &kubernetesLeases{
+		client:       kubeClient,
+		namespace:    namespace,
+		observed:     map[string]string{},
+		observedTime: map[string]time.Time{},
+	}
+}
+
+func (k *kubernetesLeases) acquireOrRenew(key, whoami string, ttl uint64) (leaseInfo, error) {
+	now := time.Now()
+	lease := time.Duration(ttl) * time.Second
+	ep, err := k.client.Endpoints(k.namespace).Get(key)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			return leaseInfo{}, err
+		}
+		// there is no current master, try to become master, create will fail if the endpoints exist
+		ep = &api.Endpoints{ObjectMeta: api.ObjectMeta{Name: key, Namespace: k.namespace}}
+	} else if current, observedTime, ok := k.observe(key, ep, now); ok {
+		if current.HolderIdentity == whoami {
+			glog.Infof("key %s already exists, we are the master (%s)", key, whoami)
+			// we extend our lease @ 1/2 of the TTL, this ensures the master doesn't flap around
+			if now.Sub(observedTime) < lease/2 {
+				return leaseInfo{holder: whoami, expiry: observedTime.Add(lease)}, nil
+			}
+		} else if expiry := observedTime.Add(time.Duration(current.TTLSeconds) * time.Second); expiry.After(now) {
+			glog.Infof("key %s already exists, the master is %s, sleeping.", key, current.HolderIdentity)
+			return leaseInfo{holder: current.HolderIdentity, expiry: expiry}, nil
+		} else {
+			glog.Infof("lease %s of %s has expired, trying to become master", key, current.HolderIdentity)
+		}
+	}
+
+	record := leaseRecord{HolderIdentity: whoami, TTLSeconds: ttl, RenewTime: now}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return leaseInfo{}, err
+	}
+	if ep.Annotations == nil {
+		ep.Annotations = map[string]string{}
+	}
+	ep.Annotations[leaseAnnotation] = string(data)
+	if len(ep.ResourceVersion) == 0 {
+		_, err = k.client.Endpoints(k.namespace).Create(ep)
+	} else {
+		_, err = k.client.Endpoints(k.namespace).Update(ep)
+	}
+	if err != nil {
+		return leaseInfo{}, err
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.observed[key], k.observedTime[key] = string(data), now
+	return leaseInfo{holder: whoami, expiry: now.Add(lease)}, nil
+}
+
+// observe returns the lease record of the given lock endpoints, and when we first saw it.
+func (k *kubernetesLeases) observe(key string, ep *api.Endpoints, now time.Time) (leaseRecord, time.Time, bool) {
+	data, ok := ep.Annotations[leaseAnnotation]
+	if !ok {
+		return leaseRecord{}, time.Time{}, false
+	}
+	var record leaseRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		glog.Errorf("Ignoring invalid lease %s %q: %v", key, data, err)
+		return leaseRecord{}, time.Time{}, false
+	}
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if observed, ok := k.observed[key]; !ok || observed != data {
+		k.observed[key], k.observedTime[key] = data, now
+	}
+	return record, k.observedTime[key], true
+}
+
+func (k *kubernetesLeases) release(key, whoami string) (bool, error) {
+	ep, err := k.client.Endpoints(k.namespace).Get(key)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	current, _, ok := k.observe(key, ep, time.Now())
+	if !ok || current.HolderIdentity != whoami {
+		return false, nil
+	}
+	// the update carries the resourceVersion we read, so it fails if another master took over since
+	delete(ep.Annotations, leaseAnnotation)
+	if _, err := k.client.Endpoints(k.namespace).Update(ep); err != nil {
+		return false, err
+	}
+	return true, nil
+}
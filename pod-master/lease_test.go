@@ -0,0 +1,319 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/client/testclient"
+	"k8s.io/kubernetes/pkg/runtime"
+
+	"github.com/coreos/go-etcd/etcd"
+)
+
+const testNamespace = "kube-system"
+
+// fakeEndpointsStore keeps endpoints by name for a testclient.Fake, and bumps their resourceVersion
+// on every write, refusing updates carrying an older one like the apiserver does.  afterGet, if set,
+// is called after each get, to let another master write in between.
+type fakeEndpointsStore struct {
+	endpoints map[string]*api.Endpoints
+	version   int
+	afterGet  func()
+}
+
+func newFakeEndpointsClient() (*testclient.Fake, *fakeEndpointsStore) {
+	store := &fakeEndpointsStore{endpoints: map[string]*api.Endpoints{}}
+	return &testclient.Fake{ReactFn: store.react}, store
+}
+
+func (s *fakeEndpointsStore) react(action testclient.Action) (runtime.Object, error) {
+	switch action.GetVerb() {
+	case "get":
+		name := action.(testclient.GetAction).GetName()
+		ep, ok := s.endpoints[name]
+		if !ok {
+			return &api.Endpoints{}, errors.NewNotFound("endpoints", name)
+		}
+		if s.afterGet != nil {
+			defer s.afterGet()
+		}
+		return copyEndpoints(ep), nil
+	case "create":
+		ep := copyEndpoints(action.(testclient.CreateAction).GetObject().(*api.Endpoints))
+		if _, ok := s.endpoints[ep.Name]; ok {
+			return &api.Endpoints{}, errors.NewAlreadyExists("endpoints", ep.Name)
+		}
+		return s.write(ep), nil
+	case "update":
+		ep := copyEndpoints(action.(testclient.UpdateAction).GetObject().(*api.Endpoints))
+		current, ok := s.endpoints[ep.Name]
+		if !ok {
+			return &api.Endpoints{}, errors.NewNotFound("endpoints", ep.Name)
+		}
+		if current.ResourceVersion != ep.ResourceVersion {
+			return &api.Endpoints{}, errors.NewConflict("endpoints", ep.Name, fmt.Errorf("resourceVersion %s is stale", ep.ResourceVersion))
+		}
+		return s.write(ep), nil
+	}
+	return nil, fmt.Errorf("unexpected action %+v", action)
+}
+
+func (s *fakeEndpointsStore) write(ep *api.Endpoints) *api.Endpoints {
+	s.version++
+	ep.ResourceVersion = strconv.Itoa(s.version)
+	s.endpoints[ep.Name] = ep
+	return copyEndpoints(ep)
+}
+
+// setLease stores the lease of holder in the lock endpoints of key, as another master would.
+func (s *fakeEndpointsStore) setLease(t *testing.T, key, holder string, renewTime time.Time) {
+	data, err := json.Marshal(leaseRecord{HolderIdentity: holder, TTLSeconds: 30, RenewTime: renewTime})
+	if err != nil {
+		t.Fatalf("Unable to encode lease: %v", err)
+	}
+	ep, ok := s.endpoints[key]
+	if !ok {
+		ep = &api.Endpoints{ObjectMeta: api.ObjectMeta{Name: key, Namespace: testNamespace}}
+	}
+	ep = copyEndpoints(ep)
+	ep.Annotations[leaseAnnotation] = string(data)
+	s.write(ep)
+}
+
+// holder returns the holder of the lease in the lock endpoints of key, "" if there is none.
+func (s *fakeEndpointsStore) holder(t *testing.T, key string) string {
+	ep, ok := s.endpoints[key]
+	if !ok || ep.Annotations[leaseAnnotation] == "" {
+		return ""
+	}
+	var record leaseRecord
+	if err := json.Unmarshal([]byte(ep.Annotations[leaseAnnotation]), &record); err != nil {
+		t.Fatalf("Unable to decode lease: %v", err)
+	}
+	return record.HolderIdentity
+}
+
+func copyEndpoints(ep *api.Endpoints) *api.Endpoints {
+	c := *ep
+	c.Annotations = map[string]string{}
+	for k, v := range ep.Annotations {
+		c.Annotations[k] = v
+	}
+	return &c
+}
+
+// expire makes k believe it first saw the current lease of key more than ttl ago.
+func expire(k *kubernetesLeases, key string, ttl uint64) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.observedTime[key] = time.Now().Add(-time.Duration(ttl+1) * time.Second)
+}
+
+func TestKubernetesLeasesAcquire(t *testing.T) {
+	fake, store := newFakeEndpointsClient()
+	k := newKubernetesLeases(fake, testNamespace)
+
+	lease, err := k.acquireOrRenew("scheduler", "me", 30)
+	if err != nil {
+		t.Fatalf("Unexpected error acquiring a new lease: %v", err)
+	}
+	if lease.holder != "me" || store.holder(t, "scheduler") != "me" {
+		t.Errorf("Expected to hold the lease, got %+v, stored holder %q", lease, store.holder(t, "scheduler"))
+	}
+	if remaining := lease.expiry.Sub(time.Now()); remaining <= 29*time.Second || remaining > 30*time.Second {
+		t.Errorf("Expected the lease to expire in 30s, got %v", remaining)
+	}
+
+	// The lease is only written again once half the ttl has gone by.
+	fake.ClearActions()
+	if lease, err = k.acquireOrRenew("scheduler", "me", 30); err != nil || lease.holder != "me" {
+		t.Fatalf("Expected to keep the lease, got %+v: %v", lease, err)
+	}
+	for _, action := range fake.Actions() {
+		if action.GetVerb() == "update" {
+			t.Errorf("Expected the lease not to be renewed yet, got %+v", action)
+		}
+	}
+	k.lock.Lock()
+	k.observedTime["scheduler"] = time.Now().Add(-20 * time.Second)
+	k.lock.Unlock()
+	version := store.endpoints["scheduler"].ResourceVersion
+	if lease, err = k.acquireOrRenew("scheduler", "me", 30); err != nil || lease.holder != "me" {
+		t.Fatalf("Expected to renew the lease, got %+v: %v", lease, err)
+	}
+	if store.endpoints["scheduler"].ResourceVersion == version {
+		t.Errorf("Expected the lease to be renewed")
+	}
+}
+
+func TestKubernetesLeasesExpiry(t *testing.T) {
+	fake, store := newFakeEndpointsClient()
+	k := newKubernetesLeases(fake, testNamespace)
+
+	// The renew time of the other master is ignored, only our own clock counts, so a lease
+	// written long ago, as far as the other master's clock goes, is only expired ttl after we
+	// first saw it.
+	store.setLease(t, "scheduler", "other", time.Now().Add(-time.Hour))
+	lease, err := k.acquireOrRenew("scheduler", "me", 30)
+	if err != nil || lease.holder != "other" {
+		t.Fatalf("Expected other to hold the lease, got %+v: %v", lease, err)
+	}
+
+	// A renewal by the other master restarts the clock.
+	expire(k, "scheduler", 30)
+	store.setLease(t, "scheduler", "other", time.Now().Add(-time.Hour))
+	if lease, err = k.acquireOrRenew("scheduler", "me", 30); err != nil || lease.holder != "other" {
+		t.Fatalf("Expected other to keep the renewed lease, got %+v: %v", lease, err)
+	}
+
+	// Without renewals, the lease is ours once it expires.
+	expire(k, "scheduler", 30)
+	if lease, err = k.acquireOrRenew("scheduler", "me", 30); err != nil || lease.holder != "me" {
+		t.Fatalf("Expected to take over the expired lease, got %+v: %v", lease, err)
+	}
+	if holder := store.holder(t, "scheduler"); holder != "me" {
+		t.Errorf("Expected the stored lease to be ours, got %q", holder)
+	}
+}
+
+func TestKubernetesLeasesConflict(t *testing.T) {
+	fake, store := newFakeEndpointsClient()
+	k := newKubernetesLeases(fake, testNamespace)
+	store.setLease(t, "scheduler", "other", time.Now())
+	if _, err := k.acquireOrRenew("scheduler", "me", 30); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Another standby takes over the expired lease between our get and update, our update
+	// carries the resourceVersion we read, so it loses.
+	expire(k, "scheduler", 30)
+	store.afterGet = func() {
+		store.afterGet = nil
+		store.setLease(t, "scheduler", "standby", time.Now())
+	}
+	lease, err := k.acquireOrRenew("scheduler", "me", 30)
+	if !errors.IsConflict(err) {
+		t.Fatalf("Expected a conflict, got %+v: %v", lease, err)
+	}
+	if holder := store.holder(t, "scheduler"); holder != "standby" {
+		t.Errorf("Expected the lease of standby to be kept, got %q", holder)
+	}
+	if lease, err = k.acquireOrRenew("scheduler", "me", 30); err != nil || lease.holder != "standby" {
+		t.Errorf("Expected standby to hold the lease, got %+v: %v", lease, err)
+	}
+}
+
+func TestKubernetesLeasesRelease(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		holder   string
+		released bool
+		expected string
+	}{
+		{desc: "our lease", holder: "me", released: true},
+		{desc: "another master's lease", holder: "other", expected: "other"},
+		{desc: "no lease"},
+	}
+	for _, tc := range testCases {
+		fake, store := newFakeEndpointsClient()
+		k := newKubernetesLeases(fake, testNamespace)
+		if tc.holder != "" {
+			store.setLease(t, "scheduler", tc.holder, time.Now())
+		}
+		released, err := k.release("scheduler", "me")
+		if err != nil || released != tc.released {
+			t.Errorf("%s: expected released %v, got %v: %v", tc.desc, tc.released, released, err)
+		}
+		if holder := store.holder(t, "scheduler"); holder != tc.expected {
+			t.Errorf("%s: expected holder %q, got %q", tc.desc, tc.expected, holder)
+		}
+	}
+}
+
+// fakeEtcd serves the compare-and-delete subset of the etcd v2 keys api, for keys holding values.
+type fakeEtcd struct {
+	lock   sync.Mutex
+	values map[string]string
+	index  int
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	key := strings.TrimPrefix(r.URL.Path, "/v2/keys")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Etcd-Index", strconv.Itoa(f.index))
+	value, ok := f.values[key]
+	switch {
+	case r.Method != "DELETE":
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"errorCode": 209, "message": "unsupported", "cause": "%s", "index": %d}`, r.Method, f.index)
+	case !ok:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(w, `{"errorCode": 100, "message": "Key not found", "cause": "%s", "index": %d}`, key, f.index)
+	case r.URL.Query().Get("prevValue") != value:
+		w.WriteHeader(http.StatusPreconditionFailed)
+		fmt.Fprintf(w, `{"errorCode": 101, "message": "Compare failed", "cause": "[%s != %s]", "index": %d}`,
+			r.URL.Query().Get("prevValue"), value, f.index)
+	default:
+		f.index++
+		delete(f.values, key)
+		fmt.Fprintf(w, `{"action": "compareAndDelete", "node": {"key": "%s", "modifiedIndex": %d}, "prevNode": {"key": "%s", "value": "%s"}}`,
+			key, f.index, key, value)
+	}
+}
+
+func TestEtcdLeasesRelease(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		holder   string
+		released bool
+		expected string
+	}{
+		{desc: "our lease", holder: "me", released: true},
+		{desc: "another master's lease", holder: "other", expected: "other"},
+		{desc: "no lease"},
+	}
+	for _, tc := range testCases {
+		fake := &fakeEtcd{values: map[string]string{}}
+		if tc.holder != "" {
+			fake.values["/scheduler"] = tc.holder
+		}
+		server := httptest.NewServer(fake)
+		defer server.Close()
+		e := &etcdLeases{etcd.NewClient([]string{server.URL})}
+
+		released, err := e.release("scheduler", "me")
+		if err != nil || released != tc.released {
+			t.Errorf("%s: expected released %v, got %v: %v", tc.desc, tc.released, released, err)
+		}
+		if holder := fake.values["/scheduler"]; holder != tc.expected {
+			t.Errorf("%s: expected holder %q, got %q", tc.desc, tc.expected, holder)
+		}
+	}
+}
@@ -14,20 +14,44 @@ See the License for the specific language governing permissions and
 limitations under the License.
 */
 
-// podmaster is a simple utility, it attempts to acquire and maintain a lease-lock from etcd using compare-and-swap.
-// if it is the master, it copies a source file into a destination file.  If it is not the master, it makes sure it is removed.
+// podmaster is a simple utility, it attempts to acquire and maintain a lease-lock from etcd using compare-and-swap,
+// or from an annotation of a kubernetes endpoints object using its resourceVersion.
+// if it is the master, it copies a source file into a destination file, replacing it whenever the source changes.  If it is not the master, it makes sure it is removed.
 //
 // typical usage is to copy a Pod manifest from a staging directory into the kubelet's directory, for example:
 //   podmaster --etcd-servers=http://127.0.0.1:4001 --key=scheduler --source-file=/kubernetes/kube-scheduler.manifest --dest-file=/manifests/kube-scheduler.manifest
+//
+// several manifests, each with its own lease, can be managed by one process with a config file:
+//   podmaster --etcd-servers=http://127.0.0.1:4001 --config-file=/kubernetes/podmaster.json
+// where podmaster.json is a list of leases:
+//   [{"key": "scheduler", "sourceFile": "/kubernetes/kube-scheduler.manifest", "destFile": "/manifests/kube-scheduler.manifest"},
+//    {"key": "controller-manager", "sourceFile": "/kubernetes/kube-controller-manager.manifest", "destFile": "/manifests/kube-controller-manager.manifest"}]
+//
+// the leases can be kept by the apiserver instead of etcd, as endpoints named after the keys in kube-system:
+//   podmaster --lease-backend=kubernetes --server=http://127.0.0.1:8080 --key=scheduler ...
+//
+// the master of each key, and whether podmaster can reach the lease backend, are served on --healthz-port
+// under /status and /healthz, along with prometheus metrics under /metrics.
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	etcdstorage "k8s.io/kubernetes/pkg/storage/etcd"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client"
+	kubectl_util "k8s.io/kubernetes/pkg/kubectl/cmd/util"
 
 	"github.com/coreos/go-etcd/etcd"
 	"github.com/golang/glog"
@@ -35,87 +59,171 @@ import (
 )
 
 type Config struct {
-	etcdServers string
-	key         string
-	whoami      string
-	ttl         uint64
-	src         string
-	dest        string
-	sleep       time.Duration
-	lastLease   time.Time
+	leaseBackend   string
+	etcdServers    string
+	leaseNamespace string
+	configFile     string
+	healthzPort    int
+	key            string
+	whoami         string
+	ttl            uint64
+	src            string
+	dest           string
+	sleep          time.Duration
+	lastLease      time.Time
+	// revision is the sha256 of the manifest we're serving in dest, empty
+	// if we aren't serving one.
+	revision string
+}
+
+// leaseConfig is an entry of --config-file, a lease and the manifest it guards.
+type leaseConfig struct {
+	Key        string `json:"key"`
+	SourceFile string `json:"sourceFile"`
+	DestFile   string `json:"destFile"`
+}
+
+// readConfigFile returns a Config for each lease listed in file, sharing the other settings of c.
+func readConfigFile(c *Config, file string) ([]*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	leases := []leaseConfig{}
+	if err := json.Unmarshal(data, &leases); err != nil {
+		return nil, err
+	}
+	if len(leases) == 0 {
+		return nil, fmt.Errorf("no leases in %s", file)
+	}
+	keys := map[string]bool{}
+	dests := map[string]bool{}
+	configs := []*Config{}
+	for i, l := range leases {
+		if len(l.Key) == 0 || len(l.SourceFile) == 0 || len(l.DestFile) == 0 {
+			return nil, fmt.Errorf("lease %d in %s needs a key, sourceFile and destFile", i, file)
+		}
+		if keys[l.Key] || dests[l.DestFile] {
+			return nil, fmt.Errorf("lease %d in %s reuses key %s or destFile %s", i, file, l.Key, l.DestFile)
+		}
+		keys[l.Key], dests[l.DestFile] = true, true
+		lc := *c
+		lc.key, lc.src, lc.dest = l.Key, l.SourceFile, l.DestFile
+		configs = append(configs, &lc)
+	}
+	return configs, nil
 }
 
-// runs the election loop. never returns.
-func (c *Config) leaseAndUpdateLoop(etcdClient *etcd.Client) {
+// runs the election loop until stop is closed, then steps down.
+func (c *Config) leaseAndUpdateLoop(leases leaseBackend, stop <-chan struct{}) {
 	for {
-		master, err := c.acquireOrRenewLease(etcdClient)
+		select {
+		case <-stop:
+			c.stepDown(leases)
+			return
+		default:
+		}
+		lease, err := leases.acquireOrRenew(c.key, c.whoami, c.ttl)
+		master := err == nil && lease.holder == c.whoami
+		if master {
+			c.lastLease = time.Now()
+		}
 		if err != nil {
-			glog.Errorf("Error in master election: %v", err)
+			glog.Errorf("Error in master election for %s: %v", c.key, err)
 			if uint64(time.Now().Sub(c.lastLease).Seconds()) < c.ttl {
+				// we only get here if we were the master, and still are as far as we know.
+				status.record(c, lease, true, err)
+				c.wait(stop)
 				continue
 			}
 			// Our lease has expired due to our own accounting, pro-actively give it
-			// up, even if we couldn't contact etcd.
-			glog.Infof("Too much time has elapsed, giving up lease.")
+			// up, even if we couldn't contact the lease backend.
+			glog.Infof("Too much time has elapsed, giving up lease %s.", c.key)
 			master = false
 		}
 		if err := c.update(master); err != nil {
-			glog.Errorf("Error updating files: %v", err)
+			glog.Errorf("Error updating %s: %v", c.dest, err)
 		}
-		time.Sleep(c.sleep)
+		status.record(c, lease, master, err)
+		c.wait(stop)
+	}
+}
+
+// wait sleeps between iterations of the election loop, or until stop is closed.
+func (c *Config) wait(stop <-chan struct{}) {
+	select {
+	case <-stop:
+	case <-time.After(c.sleep):
 	}
 }
 
-// acquireOrRenewLease either races to acquire a new master lease, or update the existing master's lease
-// returns true if we have the lease, and an error if one occurs.
-// TODO: use the master election utility once it is merged in.
-func (c *Config) acquireOrRenewLease(etcdClient *etcd.Client) (bool, error) {
-	result, err := etcdClient.Get(c.key, false, false)
+// stepDown removes dest and releases our lease, so another master can take over right away
+// instead of waiting for the lease to expire.
+func (c *Config) stepDown(leases leaseBackend) {
+	if err := c.update(false); err != nil {
+		glog.Errorf("Error removing %s: %v", c.dest, err)
+	}
+	released, err := leases.release(c.key, c.whoami)
 	if err != nil {
-		if etcdstorage.IsEtcdNotFound(err) {
-			// there is no current master, try to become master, create will fail if the key already exists
-			_, err := etcdClient.Create(c.key, c.whoami, c.ttl)
-			if err != nil {
-				return false, err
-			}
-			c.lastLease = time.Now()
-			return true, nil
-		}
-		return false, err
+		glog.Errorf("Error releasing lease %s: %v", c.key, err)
+		return
 	}
-	if result.Node.Value == c.whoami {
-		glog.Infof("key already exists, we are the master (%s)", result.Node.Value)
-		// we extend our lease @ 1/2 of the existing TTL, this ensures the master doesn't flap around
-		if result.Node.Expiration.Sub(time.Now()) < time.Duration(c.ttl/2)*time.Second {
-			_, err := etcdClient.CompareAndSwap(c.key, c.whoami, c.ttl, c.whoami, result.Node.ModifiedIndex)
-			if err != nil {
-				return false, err
-			}
-		}
-		c.lastLease = time.Now()
-		return true, nil
+	if released {
+		glog.Infof("Released lease %s", c.key)
 	}
-	glog.Infof("key already exists, the master is %s, sleeping.", result.Node.Value)
-	return false, nil
+	status.record(c, leaseInfo{}, false, nil)
 }
 
-// update enacts the policy, copying a file if we are the master, and it doesn't exist.
+// update enacts the policy, copying a file if we are the master, and dest is missing or differs from src.
 // deleting a file if we aren't the master and it does.
 func (c *Config) update(master bool) error {
-	exists, err := exists(c.dest)
+	if !master {
+		exists, err := exists(c.dest)
+		if err != nil || !exists {
+			return err
+		}
+		if err := os.Remove(c.dest); err != nil {
+			return err
+		}
+		glog.Infof("No longer the master, removed %s", c.dest)
+		c.revision = ""
+		return nil
+	}
+	data, err := ioutil.ReadFile(c.src)
 	if err != nil {
 		return err
 	}
-	switch {
-	case master && !exists:
-		return copyFile(c.src, c.dest)
-		// TODO: validate sha hash for the two files and overwrite if dest is different than src.
-	case !master && exists:
-		return os.Remove(c.dest)
+	current, err := ioutil.ReadFile(c.dest)
+	if err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	existed := err == nil
+	revision := hash(data)
+	if existed && bytes.Equal(current, data) {
+		if c.revision != revision {
+			glog.Infof("Serving %s revision %s", c.dest, revision)
+			c.revision = revision
+		}
+		return nil
+	}
+	if err := writeFileAtomic(c.dest, data, 0755); err != nil {
+		return err
+	}
+	if existed {
+		glog.Infof("Replaced %s revision %s with revision %s", c.dest, hash(current), revision)
+	} else {
+		glog.Infof("Serving %s revision %s", c.dest, revision)
+	}
+	c.revision = revision
 	return nil
 }
 
+// hash returns the sha256 of data, as a hex string.
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
 // exists tests to see if a file exists.
 func exists(file string) (bool, error) {
 	_, err := os.Stat(file)
@@ -129,36 +237,72 @@ func exists(file string) (bool, error) {
 	return true, nil
 }
 
-func copyFile(src, dest string) error {
-	data, err := ioutil.ReadFile(src)
+// writeFileAtomic writes data to a temporary file next to dest, then renames it over dest, so
+// readers never see a partially written file.  The temporary file is hidden, the kubelet ignores
+// hidden files in its manifest directory.
+func writeFileAtomic(dest string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest))
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(dest, data, 0755)
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, dest)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
 }
 
 func initFlags(c *Config) {
+	pflag.StringVar(&c.leaseBackend, "lease-backend", "etcd", "Where to keep the lock: etcd, or kubernetes to keep it in an annotation of an endpoints object named after the key.")
 	pflag.StringVar(&c.etcdServers, "etcd-servers", "", "The comma-seprated list of etcd servers to use")
+	pflag.StringVar(&c.leaseNamespace, "lease-namespace", api.NamespaceSystem, "The namespace of the lock endpoints, with --lease-backend=kubernetes.")
+	pflag.StringVar(&c.configFile, "config-file", "", "A json file listing the keys, source and dest files to manage, instead of --key, --source-file and --dest-file.")
 	pflag.StringVar(&c.key, "key", "", "The key to use for the lock")
 	pflag.StringVar(&c.whoami, "whoami", "", "The name to use for the reservation.  If empty use os.Hostname")
 	pflag.Uint64Var(&c.ttl, "ttl-secs", 30, "The time to live for the lock.")
 	pflag.StringVar(&c.src, "source-file", "", "The source file to copy from.")
 	pflag.StringVar(&c.dest, "dest-file", "", "The destination file to copy to.")
 	pflag.DurationVar(&c.sleep, "sleep", 5*time.Second, "The length of time to sleep between checking the lock.")
+	pflag.IntVar(&c.healthzPort, "healthz-port", 0, "The port serving /healthz, /status and /metrics, 0 to disable.")
 }
 
 func validateFlags(c *Config) {
-	if len(c.etcdServers) == 0 {
-		glog.Fatalf("--etcd-servers=<server-list> is required")
-	}
-	if len(c.key) == 0 {
-		glog.Fatalf("--key=<some-key> is required")
-	}
-	if len(c.src) == 0 {
-		glog.Fatalf("--source-file=<some-file> is required")
+	switch c.leaseBackend {
+	case "etcd":
+		if len(c.etcdServers) == 0 {
+			glog.Fatalf("--etcd-servers=<server-list> is required")
+		}
+	case "kubernetes":
+	default:
+		glog.Fatalf("--lease-backend must be etcd or kubernetes, not %s", c.leaseBackend)
 	}
-	if len(c.dest) == 0 {
-		glog.Fatalf("--dest-file=<some-file> is required")
+	if len(c.configFile) != 0 {
+		if len(c.key) != 0 || len(c.src) != 0 || len(c.dest) != 0 {
+			glog.Fatalf("--config-file can't be used with --key, --source-file or --dest-file")
+		}
+	} else {
+		if len(c.key) == 0 {
+			glog.Fatalf("--key=<some-key> is required")
+		}
+		if len(c.src) == 0 {
+			glog.Fatalf("--source-file=<some-file> is required")
+		}
+		if len(c.dest) == 0 {
+			glog.Fatalf("--dest-file=<some-file> is required")
+		}
 	}
 	if len(c.whoami) == 0 {
 		hostname, err := os.Hostname()
@@ -173,11 +317,57 @@ func validateFlags(c *Config) {
 func main() {
 	c := Config{}
 	initFlags(&c)
+	clientConfig := kubectl_util.DefaultClientConfig(pflag.CommandLine)
 	pflag.Parse()
 	validateFlags(&c)
+	if c.healthzPort != 0 {
+		go healthzServer(c.healthzPort)
+	}
 
-	machines := strings.Split(c.etcdServers, ",")
-	etcdClient := etcd.NewClient(machines)
+	configs := []*Config{&c}
+	if len(c.configFile) != 0 {
+		var err error
+		if configs, err = readConfigFile(&c, c.configFile); err != nil {
+			glog.Fatalf("Failed to read --config-file: %v", err)
+		}
+	}
 
-	c.leaseAndUpdateLoop(etcdClient)
+	// The election loops are independent, but share the connections to the lease backend.
+	var leases leaseBackend
+	switch c.leaseBackend {
+	case "etcd":
+		machines := strings.Split(c.etcdServers, ",")
+		leases = &etcdLeases{etcd.NewClient(machines)}
+	case "kubernetes":
+		config, err := clientConfig.ClientConfig()
+		if err != nil {
+			glog.Fatalf("Failed to configure the kubernetes client: %v", err)
+		}
+		kubeClient, err := client.New(config)
+		if err != nil {
+			glog.Fatalf("Failed to create the kubernetes client: %v", err)
+		}
+		leases = newKubernetesLeases(kubeClient, c.leaseNamespace)
+	}
+
+	// On SIGTERM or SIGINT, e.g. when the node is drained, every loop steps down before we exit.
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		glog.Infof("Received %v, stepping down", sig)
+		close(stop)
+	}()
+
+	var wg sync.WaitGroup
+	for _, lc := range configs {
+		wg.Add(1)
+		go func(lc *Config) {
+			defer wg.Done()
+			lc.leaseAndUpdateLoop(leases, stop)
+		}(lc)
+	}
+	wg.Wait()
+	glog.Flush()
 }
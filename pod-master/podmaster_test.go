@@ -0,0 +1,321 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestConfig returns a Config copying src to dest in a temporary directory, which the caller
+// must remove.
+func newTestConfig(t *testing.T) *Config {
+	dir, err := ioutil.TempDir("", "podmaster")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	return &Config{
+		key:    "scheduler",
+		whoami: "me",
+		ttl:    30,
+		src:    filepath.Join(dir, "src.manifest"),
+		dest:   filepath.Join(dir, "dest.manifest"),
+	}
+}
+
+// writeFile writes data to file, failing the test on error.
+func writeFile(t *testing.T, file, data string) {
+	if err := ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %v", file, err)
+	}
+}
+
+// readDest returns the contents of dest, and whether it exists.
+func readDest(t *testing.T, c *Config) (string, bool) {
+	data, err := ioutil.ReadFile(c.dest)
+	if os.IsNotExist(err) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatalf("Unable to read %s: %v", c.dest, err)
+	}
+	return string(data), true
+}
+
+func TestUpdate(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		src      string
+		dest     string
+		hasDest  bool
+		master   bool
+		expected string
+		exists   bool
+	}{
+		{desc: "master copies src", src: "a", master: true, expected: "a", exists: true},
+		{desc: "master keeps an identical dest", src: "a", dest: "a", hasDest: true, master: true, expected: "a", exists: true},
+		{desc: "master replaces a changed dest", src: "b", dest: "a", hasDest: true, master: true, expected: "b", exists: true},
+		{desc: "standby removes dest", src: "a", dest: "a", hasDest: true},
+		{desc: "standby without dest", src: "a"},
+	}
+	for _, tc := range testCases {
+		c := newTestConfig(t)
+		defer os.RemoveAll(filepath.Dir(c.src))
+		writeFile(t, c.src, tc.src)
+		if tc.hasDest {
+			writeFile(t, c.dest, tc.dest)
+		}
+
+		if err := c.update(tc.master); err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.desc, err)
+			continue
+		}
+		data, exists := readDest(t, c)
+		if exists != tc.exists || data != tc.expected {
+			t.Errorf("%s: expected dest %q (exists %v), got %q (exists %v)", tc.desc, tc.expected, tc.exists, data, exists)
+		}
+		revision := ""
+		if tc.master {
+			revision = hash([]byte(tc.src))
+		}
+		if c.revision != revision {
+			t.Errorf("%s: expected revision %q, got %q", tc.desc, revision, c.revision)
+		}
+		// Nothing but dest is left behind in the directory.
+		files, _ := filepath.Glob(filepath.Join(filepath.Dir(c.dest), ".*"))
+		if len(files) != 0 {
+			t.Errorf("%s: expected no temporary files, got %v", tc.desc, files)
+		}
+	}
+}
+
+func TestUpdateMissingSource(t *testing.T) {
+	c := newTestConfig(t)
+	defer os.RemoveAll(filepath.Dir(c.src))
+	writeFile(t, c.dest, "a")
+
+	// The current manifest is kept until the source can be read.
+	if err := c.update(true); err == nil {
+		t.Errorf("Expected an error without a source file")
+	}
+	if data, exists := readDest(t, c); !exists || data != "a" {
+		t.Errorf("Expected dest to be kept, got %q (exists %v)", data, exists)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	c := newTestConfig(t)
+	defer os.RemoveAll(filepath.Dir(c.src))
+	writeFile(t, c.dest, "old")
+
+	if err := writeFileAtomic(c.dest, []byte("new"), 0600); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if data, _ := readDest(t, c); data != "new" {
+		t.Errorf("Expected dest to be replaced, got %q", data)
+	}
+	if info, err := os.Stat(c.dest); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v: %v", info.Mode(), err)
+	}
+	files, _ := filepath.Glob(filepath.Join(filepath.Dir(c.dest), ".*"))
+	if len(files) != 0 {
+		t.Errorf("Expected no temporary files, got %v", files)
+	}
+
+	// Errors creating the temporary file are returned.
+	if err := writeFileAtomic(filepath.Join(c.dest+".missing", "dest"), []byte("new"), 0600); err == nil {
+		t.Errorf("Expected an error writing to a missing directory")
+	}
+}
+
+func TestReadConfigFile(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		config string
+		keys   []string
+		valid  bool
+	}{
+		{
+			desc: "two leases",
+			config: `[{"key": "scheduler", "sourceFile": "/src/scheduler", "destFile": "/dest/scheduler"},
+				{"key": "controller-manager", "sourceFile": "/src/cm", "destFile": "/dest/cm"}]`,
+			keys:  []string{"scheduler", "controller-manager"},
+			valid: true,
+		},
+		{desc: "invalid json", config: `{"key": "scheduler"}`},
+		{desc: "no leases", config: `[]`},
+		{desc: "missing destFile", config: `[{"key": "scheduler", "sourceFile": "/src/scheduler"}]`},
+		{
+			desc: "duplicate key",
+			config: `[{"key": "scheduler", "sourceFile": "/src/a", "destFile": "/dest/a"},
+				{"key": "scheduler", "sourceFile": "/src/b", "destFile": "/dest/b"}]`,
+		},
+		{
+			desc: "duplicate destFile",
+			config: `[{"key": "a", "sourceFile": "/src/a", "destFile": "/dest/scheduler"},
+				{"key": "b", "sourceFile": "/src/b", "destFile": "/dest/scheduler"}]`,
+		},
+	}
+	for _, tc := range testCases {
+		c := newTestConfig(t)
+		defer os.RemoveAll(filepath.Dir(c.src))
+		file := filepath.Join(filepath.Dir(c.src), "podmaster.json")
+		writeFile(t, file, tc.config)
+
+		configs, err := readConfigFile(c, file)
+		if (err == nil) != tc.valid {
+			t.Errorf("%s: expected valid %v, got %v", tc.desc, tc.valid, err)
+			continue
+		}
+		if len(configs) != len(tc.keys) {
+			t.Errorf("%s: expected %d leases, got %d", tc.desc, len(tc.keys), len(configs))
+			continue
+		}
+		for i, lc := range configs {
+			// Every lease shares the other settings, but has its own state.
+			if lc.key != tc.keys[i] || lc.whoami != c.whoami || lc.ttl != c.ttl || lc == c {
+				t.Errorf("%s: unexpected lease %d %+v", tc.desc, i, lc)
+			}
+		}
+	}
+}
+
+// fakeLeases is a leaseBackend holding a single lease, failing every call with err if it is set.
+type fakeLeases struct {
+	lock     sync.Mutex
+	holder   string
+	err      error
+	acquires int
+	releases int
+}
+
+func (f *fakeLeases) acquireOrRenew(key, whoami string, ttl uint64) (leaseInfo, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.acquires++
+	if f.err != nil {
+		return leaseInfo{}, f.err
+	}
+	if f.holder == "" {
+		f.holder = whoami
+	}
+	return leaseInfo{holder: f.holder, expiry: time.Now().Add(time.Duration(ttl) * time.Second)}, nil
+}
+
+func (f *fakeLeases) release(key, whoami string) (bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.releases++
+	if f.err != nil {
+		return false, f.err
+	}
+	if f.holder != whoami {
+		return false, nil
+	}
+	f.holder = ""
+	return true, nil
+}
+
+func (f *fakeLeases) set(holder string, err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.holder, f.err = holder, err
+}
+
+func (f *fakeLeases) calls() (int, int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.acquires, f.releases
+}
+
+func TestLeaseAndUpdateLoop(t *testing.T) {
+	c := newTestConfig(t)
+	defer os.RemoveAll(filepath.Dir(c.src))
+	c.sleep = 10 * time.Millisecond
+	writeFile(t, c.src, "a")
+	leases := &fakeLeases{}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.leaseAndUpdateLoop(leases, stop)
+		close(done)
+	}()
+
+	// Lease errors while the lease is still ours keep dest, and are retried after sleeping.
+	time.Sleep(50 * time.Millisecond)
+	if data, exists := readDest(t, c); !exists || data != "a" {
+		t.Errorf("Expected to serve dest as the master, got %q (exists %v)", data, exists)
+	}
+	leases.set("me", fmt.Errorf("etcd is down"))
+	before, _ := leases.calls()
+	time.Sleep(100 * time.Millisecond)
+	after, _ := leases.calls()
+	if retries := after - before; retries < 2 || retries > 20 {
+		t.Errorf("Expected about 10 retries in 100ms, got %d", retries)
+	}
+	if _, exists := readDest(t, c); !exists {
+		t.Errorf("Expected dest to be kept while the lease may still be ours")
+	}
+
+	// Stopping steps down.
+	leases.set("me", nil)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the loop to stop")
+	}
+	if _, exists := readDest(t, c); exists {
+		t.Errorf("Expected dest to be removed")
+	}
+	if _, releases := leases.calls(); releases != 1 {
+		t.Errorf("Expected the lease to be released once, got %d", releases)
+	}
+}
+
+func TestStepDown(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		holder string
+		err    error
+		holds  string
+	}{
+		{desc: "our lease", holder: "me"},
+		{desc: "another master's lease", holder: "other", holds: "other"},
+		{desc: "unreachable backend", holder: "me", err: fmt.Errorf("etcd is down"), holds: "me"},
+	}
+	for _, tc := range testCases {
+		c := newTestConfig(t)
+		defer os.RemoveAll(filepath.Dir(c.src))
+		writeFile(t, c.dest, "a")
+		leases := &fakeLeases{holder: tc.holder, err: tc.err}
+
+		// dest goes away even if the lease can't be released, it expires soon enough.
+		c.stepDown(leases)
+		if _, exists := readDest(t, c); exists {
+			t.Errorf("%s: expected dest to be removed", tc.desc)
+		}
+		if leases.holder != tc.holds {
+			t.Errorf("%s: expected the lease to be held by %q, got %q", tc.desc, tc.holds, leases.holder)
+		}
+	}
+}
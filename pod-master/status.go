@@ -0,0 +1,181 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "podmaster"
+
+var (
+	// transitions counts changes of our role for each key, by the role we changed to: master or standby.
+	transitions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "transitions_total",
+		Help:      "Number of times this podmaster became the master, or stopped being the master, by key and role.",
+	}, []string{"key", "role"})
+
+	// leaseErrors counts failed attempts to acquire or renew a lease, eg: etcd is unreachable.
+	leaseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "lease_errors_total",
+		Help:      "Number of failed attempts to acquire or renew a lease, by key.",
+	}, []string{"key"})
+
+	masterSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "master_seconds_total",
+		Help:      "Time spent as the master, by key.",
+	}, []string{"key"})
+
+	isMaster = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "master",
+		Help:      "1 if this podmaster is the master, 0 otherwise, by key.",
+	}, []string{"key"})
+)
+
+func init() {
+	prometheus.MustRegister(transitions)
+	prometheus.MustRegister(leaseErrors)
+	prometheus.MustRegister(masterSeconds)
+	prometheus.MustRegister(isMaster)
+}
+
+// leaseStatus is what /status reports about a lease.
+type leaseStatus struct {
+	Key      string `json:"key"`
+	Holder   string `json:"holder"`
+	IsMaster bool   `json:"isMaster"`
+	// Expiry is when the lease expires unless it's renewed.
+	Expiry time.Time `json:"expiry"`
+	// LastRenewal is when we last acquired the lease, or renewed it extending its expiry.
+	LastRenewal time.Time `json:"lastRenewal"`
+	// Revision is the sha256 of the manifest we're serving, if we are the master.
+	Revision      string    `json:"revision,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorTime time.Time `json:"lastErrorTime"`
+
+	// failing is true if the last attempt to acquire or renew the lease failed.
+	failing bool
+	// updated is when the status was last recorded, to account for the time spent as master.
+	updated time.Time
+}
+
+// statusState holds the status of every lease.
+type statusState struct {
+	lock   sync.Mutex
+	leases map[string]*leaseStatus
+}
+
+var status = &statusState{leases: map[string]*leaseStatus{}}
+
+// record records the outcome of an iteration of the election loop of c, and updates the metrics.
+func (s *statusState) record(c *Config, lease leaseInfo, master bool, err error) {
+	now := time.Now()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ls, ok := s.leases[c.key]
+	if !ok {
+		ls = &leaseStatus{Key: c.key, updated: now}
+		s.leases[c.key] = ls
+	}
+	if ls.IsMaster {
+		masterSeconds.WithLabelValues(c.key).Add(now.Sub(ls.updated).Seconds())
+	}
+	if master != ls.IsMaster {
+		role := "standby"
+		if master {
+			role = "master"
+		}
+		transitions.WithLabelValues(c.key, role).Inc()
+	}
+	if master {
+		isMaster.WithLabelValues(c.key).Set(1)
+	} else {
+		isMaster.WithLabelValues(c.key).Set(0)
+	}
+
+	ls.failing = err != nil
+	if err != nil {
+		leaseErrors.WithLabelValues(c.key).Inc()
+		ls.LastError, ls.LastErrorTime = err.Error(), now
+		// keep the last known holder and expiry.
+		ls.IsMaster, ls.updated, ls.Revision = master, now, c.revision
+		return
+	}
+	// backends confirm a lease without renewing it until half its ttl is gone, only a new
+	// expiry means we acquired or renewed it.
+	if master && (!ls.IsMaster || !lease.expiry.Equal(ls.Expiry)) {
+		ls.LastRenewal = now
+	}
+	ls.IsMaster, ls.updated, ls.Revision = master, now, c.revision
+	ls.Holder, ls.Expiry = lease.holder, lease.expiry
+}
+
+// getStatus returns the status of every lease, sorted by key.
+func (s *statusState) getStatus() []leaseStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := []string{}
+	for key := range s.leases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	statuses := []leaseStatus{}
+	for _, key := range keys {
+		statuses = append(statuses, *s.leases[key])
+	}
+	return statuses
+}
+
+// healthzServer serves /healthz, failing while any lease can't be acquired or renewed, /status with the
+// status of every lease as json, and the prometheus metrics under /metrics.  errors, eg: the port is
+// in use, are logged but don't stop podmaster, the leases matter more than reporting on them.
+func healthzServer(port int) {
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		failing := []string{}
+		for _, ls := range status.getStatus() {
+			if ls.failing {
+				failing = append(failing, fmt.Sprintf("%s: %s", ls.Key, ls.LastError))
+			}
+		}
+		if len(failing) != 0 {
+			http.Error(w, strings.Join(failing, "\n"), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status.getStatus())
+	})
+	http.Handle("/metrics", prometheus.Handler())
+	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
+		glog.Errorf("Unable to serve /healthz on port %d: %v", port, err)
+	}
+}
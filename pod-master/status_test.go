@@ -0,0 +1,123 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// metricValue returns the value of a counter or gauge.
+func metricValue(t *testing.T, m prometheus.Metric) float64 {
+	var out dto.Metric
+	if err := m.Write(&out); err != nil {
+		t.Fatalf("Unable to read metric: %v", err)
+	}
+	if out.Counter != nil {
+		return out.Counter.GetValue()
+	}
+	return out.Gauge.GetValue()
+}
+
+func TestStatusRecord(t *testing.T) {
+	// the metrics are global, every step checks what it added to them.
+	c := &Config{key: "status-record", whoami: "me"}
+	s := &statusState{leases: map[string]*leaseStatus{}}
+	now := time.Now()
+	expiry, renewedExpiry := now.Add(30*time.Second), now.Add(45*time.Second)
+	testCases := []struct {
+		desc      string
+		lease     leaseInfo
+		master    bool
+		err       error
+		holder    string
+		expiry    time.Time
+		failing   bool
+		renewed   bool
+		toMaster  float64
+		toStandby float64
+		errors    float64
+	}{
+		{
+			desc:   "another master",
+			lease:  leaseInfo{holder: "other", expiry: expiry},
+			holder: "other", expiry: expiry,
+		},
+		{
+			desc:   "acquired",
+			lease:  leaseInfo{holder: "me", expiry: expiry},
+			master: true, holder: "me", expiry: expiry, renewed: true, toMaster: 1,
+		},
+		{
+			desc:   "confirmed",
+			lease:  leaseInfo{holder: "me", expiry: expiry},
+			master: true, holder: "me", expiry: expiry,
+		},
+		{
+			desc:   "renewed",
+			lease:  leaseInfo{holder: "me", expiry: renewedExpiry},
+			master: true, holder: "me", expiry: renewedExpiry, renewed: true,
+		},
+		{
+			desc:   "error within the ttl",
+			master: true, err: fmt.Errorf("etcd is down"),
+			holder: "me", expiry: renewedExpiry, failing: true, errors: 1,
+		},
+		{
+			desc:   "lost",
+			lease:  leaseInfo{holder: "other", expiry: expiry},
+			holder: "other", expiry: expiry, toStandby: 1,
+		},
+	}
+	metrics := func() (float64, float64, float64) {
+		return metricValue(t, transitions.WithLabelValues(c.key, "master")),
+			metricValue(t, transitions.WithLabelValues(c.key, "standby")),
+			metricValue(t, leaseErrors.WithLabelValues(c.key))
+	}
+	lastRenewal := time.Time{}
+	for _, tc := range testCases {
+		toMaster, toStandby, errors := metrics()
+		time.Sleep(time.Millisecond)
+		s.record(c, tc.lease, tc.master, tc.err)
+
+		ls := s.getStatus()[0]
+		if ls.IsMaster != tc.master || ls.Holder != tc.holder || !ls.Expiry.Equal(tc.expiry) || ls.failing != tc.failing {
+			t.Errorf("%s: unexpected status %+v", tc.desc, ls)
+		}
+		if renewed := !ls.LastRenewal.Equal(lastRenewal); renewed != tc.renewed {
+			t.Errorf("%s: expected renewed %v, got last renewal %v, was %v", tc.desc, tc.renewed, ls.LastRenewal, lastRenewal)
+		}
+		lastRenewal = ls.LastRenewal
+
+		master := 0.0
+		if tc.master {
+			master = 1
+		}
+		if v := metricValue(t, isMaster.WithLabelValues(c.key)); v != master {
+			t.Errorf("%s: expected master gauge %v, got %v", tc.desc, master, v)
+		}
+		newToMaster, newToStandby, newErrors := metrics()
+		if newToMaster-toMaster != tc.toMaster || newToStandby-toStandby != tc.toStandby || newErrors-errors != tc.errors {
+			t.Errorf("%s: expected +%v master, +%v standby transitions and +%v errors, got +%v, +%v and +%v", tc.desc,
+				tc.toMaster, tc.toStandby, tc.errors, newToMaster-toMaster, newToStandby-toStandby, newErrors-errors)
+		}
+	}
+}
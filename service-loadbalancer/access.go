@@ -0,0 +1,91 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// lbAllowCIDRsKey and lbDenyCIDRsKey are the service annotations holding
+	// comma separated lists of source cidrs, or ips, allowed to, or denied
+	// from, reaching the service. Denied sources win over allowed ones.
+	lbAllowCIDRsKey = "serviceloadbalancer/lb.allow-cidrs"
+	lbDenyCIDRsKey  = "serviceloadbalancer/lb.deny-cidrs"
+
+	// lbRateLimitKey is the service annotation holding the number of
+	// requests, or connections for tcp services, a client can make per
+	// second. Clients going over the limit are rejected.
+	lbRateLimitKey = "serviceloadbalancer/lb.rate-limit"
+)
+
+// setAccessSettings fills in the access restrictions of svc from the
+// annotations of s. Invalid cidrs are reported and left out of the lists.
+// Returns an error if every cidr of the allow list is invalid, the service
+// must not be loadbalanced then, since an empty allow list allows everyone.
+func (lbc *loadBalancerController) setAccessSettings(s *api.Service, svc *service) error {
+	var invalid int
+	svc.AllowCIDRs, invalid = lbc.getCIDRAnnotation(s, lbAllowCIDRsKey)
+	if invalid > 0 && len(svc.AllowCIDRs) == 0 {
+		return fmt.Errorf("%v has no valid cidrs", lbAllowCIDRsKey)
+	}
+	svc.DenyCIDRs, _ = lbc.getCIDRAnnotation(s, lbDenyCIDRsKey)
+	if limit, ok := s.Annotations[lbRateLimitKey]; ok {
+		n, err := strconv.Atoi(limit)
+		if err == nil && n < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+		if err != nil {
+			lbc.reportInvalidAnnotation(s, lbRateLimitKey, limit, err)
+		} else {
+			svc.RateLimit = n
+		}
+	}
+	return nil
+}
+
+// getCIDRAnnotation returns the cidrs in the given annotation, ips are turned
+// into single address cidrs, and the number of invalid entries left out.
+func (lbc *loadBalancerController) getCIDRAnnotation(s *api.Service, key string) (cidrs []string, invalid int) {
+	for _, cidr := range strings.Split(s.Annotations[key], ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		if ip := net.ParseIP(cidr); ip != nil {
+			if ip.To4() != nil {
+				cidrs = append(cidrs, cidr+"/32")
+			} else {
+				cidrs = append(cidrs, cidr+"/128")
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			lbc.reportInvalidAnnotation(s, key, cidr, fmt.Errorf("not a cidr or ip"))
+			invalid++
+			continue
+		}
+		cidrs = append(cidrs, ipNet.String())
+	}
+	return cidrs, invalid
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+func TestSetAccessSettings(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		expected    service
+		events      int
+		err         bool
+	}{
+		{
+			expected: service{},
+		},
+		{
+			annotations: map[string]string{
+				lbAllowCIDRsKey: "10.0.0.0/8, 192.168.1.7,fd00::/8",
+				lbDenyCIDRsKey:  "10.1.2.3/16",
+				lbRateLimitKey:  "10",
+			},
+			expected: service{
+				AllowCIDRs: []string{"10.0.0.0/8", "192.168.1.7/32", "fd00::/8"},
+				DenyCIDRs:  []string{"10.1.0.0/16"},
+				RateLimit:  10,
+			},
+		},
+		{
+			annotations: map[string]string{
+				lbAllowCIDRsKey: "10.0.0.0/8,10.0.0.0/33,internal",
+				lbRateLimitKey:  "0",
+			},
+			expected: service{AllowCIDRs: []string{"10.0.0.0/8"}},
+			events:   3,
+		},
+		{
+			// An allow list without valid cidrs doesn't allow everyone.
+			annotations: map[string]string{
+				lbAllowCIDRsKey: "10.0.0.0/33, internal",
+			},
+			expected: service{},
+			events:   2,
+			err:      true,
+		},
+		{
+			annotations: map[string]string{
+				lbDenyCIDRsKey: "internal",
+			},
+			expected: service{},
+			events:   1,
+		},
+	}
+	for i, tc := range testCases {
+		flb := newFakeLoadBalancerController(nil, nil)
+		s := getService(nil)
+		s.Annotations = tc.annotations
+
+		svc := service{}
+		if err := flb.setAccessSettings(s, &svc); (err != nil) != tc.err {
+			t.Errorf("Test %d: expected error %v, got %v", i, tc.err, err)
+		}
+		if !reflect.DeepEqual(svc, tc.expected) {
+			t.Errorf("Test %d: expected %+v, got %+v", i, tc.expected, svc)
+		}
+		if events := flb.recorder.(*fakeEventRecorder).events; len(events) != tc.events {
+			t.Errorf("Test %d: expected %d events, got %+v", i, tc.events, events)
+		}
+	}
+}
+
+func TestGetServicesInvalidAllowList(t *testing.T) {
+	endpointAddresses := []api.EndpointAddress{
+		{IP: "1.2.3.4"},
+	}
+	endpointPorts := []api.EndpointPort{
+		{Port: 80, Protocol: "TCP"},
+	}
+	servicePorts := []api.ServicePort{
+		{Port: 80, TargetPort: util.NewIntOrStringFromInt(80)},
+	}
+	svc := getService(servicePorts)
+	svc.Annotations = map[string]string{lbAllowCIDRsKey: "internal"}
+	flb := newFakeLoadBalancerController([]*api.Endpoints{getEndpoints(svc, endpointAddresses, endpointPorts)}, []*api.Service{svc})
+
+	http, _, _ := flb.getServices()
+	if len(http) != 0 {
+		t.Errorf("Expected the service not to be loadbalanced, got %+v", http)
+	}
+	status := flb.statuses[ns+"/"+svc.Name]
+	if len(status.Ports) != 1 || !strings.Contains(status.Ports[0].Reason, lbAllowCIDRsKey) {
+		t.Errorf("Expected the status to say why the port is skipped, got %+v", status.Ports)
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// lbAlgorithmKey is the service annotation overriding the loadbalancing
+	// algorithm in loadbalancer.json, one of validAlgorithms.
+	lbAlgorithmKey = "serviceloadbalancer/lb.algorithm"
+
+	// lbCookieStickySessionKey is the service annotation that, if "true",
+	// pins http clients to an endpoint with a cookie.
+	lbCookieStickySessionKey = "serviceloadbalancer/lb.cookie-sticky-session"
+
+	// lbTimeoutServerKey is the service annotation holding the time to wait
+	// for an endpoint to respond, as a duration, eg: 5m.
+	lbTimeoutServerKey = "serviceloadbalancer/lb.timeout-server"
+
+	// lbSendProxyKey is the service annotation that makes the loadbalancer
+	// send the PROXY protocol header, v1 or v2, to the endpoints of tcp
+	// services, so they see the address of the client.
+	lbSendProxyKey = "serviceloadbalancer/lb.send-proxy"
+
+	// lbForwardedHeadersKey is the service annotation that, if "true",
+	// adds X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Port headers
+	// to the requests sent to the endpoints of http services.
+	lbForwardedHeadersKey = "serviceloadbalancer/lb.forwarded-headers"
+
+	// defaultAlgorithm is used if neither loadbalancer.json nor the service
+	// specify an algorithm.
+	defaultAlgorithm = "roundrobin"
+
+	// invalidAnnotationReason is the reason of events about service
+	// annotations that couldn't be parsed.
+	invalidAnnotationReason = "InvalidAnnotation"
+)
+
+// validAlgorithms are the loadbalancing algorithms backends need to support.
+// source pins clients to an endpoint by hashing their ip.
+var validAlgorithms = map[string]bool{
+	"roundrobin": true,
+	"leastconn":  true,
+	"source":     true,
+}
+
+// reportInvalidAnnotation logs, and records an event on the service, that the
+// value of the given annotation is ignored.
+func (lbc *loadBalancerController) reportInvalidAnnotation(s *api.Service, key, value string, reason error) {
+	glog.Errorf("Ignoring %v=%q for service %v/%v: %v", key, value, s.Namespace, s.Name, reason)
+	lbc.eventf(s, invalidAnnotationReason, "Ignoring %v=%q: %v", key, value, reason)
+}
+
+// setServiceSettings fills in the per-service loadbalancing settings of svc
+// from the annotations of s. Invalid values are reported and replaced by the
+// defaults, unless that would expose the service more than asked for, see
+// setAccessSettings.
+func (lbc *loadBalancerController) setServiceSettings(s *api.Service, svc *service) error {
+	svc.Algorithm = defaultAlgorithm
+	if lbc.cfg.Algorithm != "" {
+		svc.Algorithm = lbc.cfg.Algorithm
+	}
+	if s.Spec.SessionAffinity == api.ServiceAffinityClientIP {
+		svc.Algorithm = "source"
+	}
+	if algorithm, ok := s.Annotations[lbAlgorithmKey]; ok {
+		if validAlgorithms[algorithm] {
+			svc.Algorithm = algorithm
+		} else {
+			lbc.reportInvalidAnnotation(s, lbAlgorithmKey, algorithm,
+				fmt.Errorf("must be one of roundrobin, leastconn or source"))
+		}
+	}
+
+	if sticky, ok := s.Annotations[lbCookieStickySessionKey]; ok {
+		if b, err := strconv.ParseBool(sticky); err != nil {
+			lbc.reportInvalidAnnotation(s, lbCookieStickySessionKey, sticky, err)
+		} else {
+			svc.CookieStickySession = b
+		}
+	}
+
+	if version, ok := s.Annotations[lbSendProxyKey]; ok {
+		if version == "v1" || version == "v2" {
+			svc.SendProxy = version
+		} else {
+			lbc.reportInvalidAnnotation(s, lbSendProxyKey, version, fmt.Errorf("must be v1 or v2"))
+		}
+	}
+
+	if forwarded, ok := s.Annotations[lbForwardedHeadersKey]; ok {
+		if b, err := strconv.ParseBool(forwarded); err != nil {
+			lbc.reportInvalidAnnotation(s, lbForwardedHeadersKey, forwarded, err)
+		} else {
+			svc.ForwardedHeaders = b
+		}
+	}
+
+	if timeout, ok := s.Annotations[lbTimeoutServerKey]; ok {
+		if d, err := time.ParseDuration(timeout); err != nil {
+			lbc.reportInvalidAnnotation(s, lbTimeoutServerKey, timeout, err)
+		} else if d < time.Millisecond {
+			lbc.reportInvalidAnnotation(s, lbTimeoutServerKey, timeout,
+				fmt.Errorf("must be at least 1ms"))
+		} else {
+			svc.TimeoutServer = int(d / time.Millisecond)
+		}
+	}
+
+	return lbc.setAccessSettings(s, svc)
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+)
+
+func TestSetServiceSettings(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		affinity    api.ServiceAffinity
+		expected    service
+		events      int
+	}{
+		{
+			expected: service{Algorithm: "leastconn"},
+		},
+		{
+			affinity: api.ServiceAffinityClientIP,
+			expected: service{Algorithm: "source"},
+		},
+		{
+			annotations: map[string]string{
+				lbAlgorithmKey:           "roundrobin",
+				lbCookieStickySessionKey: "true",
+				lbTimeoutServerKey:       "2m",
+				lbSendProxyKey:           "v1",
+				lbForwardedHeadersKey:    "true",
+			},
+			expected: service{Algorithm: "roundrobin", CookieStickySession: true, TimeoutServer: 120000,
+				SendProxy: "v1", ForwardedHeaders: true},
+		},
+		{
+			annotations: map[string]string{
+				lbAlgorithmKey:           "random",
+				lbCookieStickySessionKey: "yes please",
+				lbTimeoutServerKey:       "0s",
+				lbSendProxyKey:           "v3",
+				lbForwardedHeadersKey:    "sure",
+			},
+			expected: service{Algorithm: "leastconn"},
+			events:   5,
+		},
+	}
+	for i, tc := range testCases {
+		flb := newFakeLoadBalancerController(nil, nil)
+		flb.cfg.Algorithm = "leastconn"
+		s := getService(nil)
+		s.Annotations = tc.annotations
+		s.Spec.SessionAffinity = tc.affinity
+
+		svc := service{}
+		flb.setServiceSettings(s, &svc)
+		if svc.Algorithm != tc.expected.Algorithm ||
+			svc.CookieStickySession != tc.expected.CookieStickySession ||
+			svc.TimeoutServer != tc.expected.TimeoutServer ||
+			svc.SendProxy != tc.expected.SendProxy ||
+			svc.ForwardedHeaders != tc.expected.ForwardedHeaders {
+			t.Errorf("Test %d: expected %+v, got %+v", i, tc.expected, svc)
+		}
+		if events := flb.recorder.(*fakeEventRecorder).events; len(events) != tc.events {
+			t.Errorf("Test %d: expected %d events, got %+v", i, tc.events, events)
+		}
+	}
+}
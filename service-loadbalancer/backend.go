@@ -0,0 +1,171 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"text/template"
+
+	"github.com/golang/glog"
+)
+
+// loadBalancerBackend is implemented by each proxy the controller can drive.
+// The backend is selected by the name in loadbalancer.json.
+type loadBalancerBackend interface {
+	// render writes the proxy config for the given services to w.
+	render(w io.Writer, services map[string][]service) error
+
+	// validate checks the config at the given path, without using it.
+	validate(path string) error
+
+	// reload makes the proxy pick up the config file, starting it if needed.
+	// It returns the output of the reload.
+	reload() (string, error)
+
+	// healthz returns an error if the proxy isn't serving.
+	healthz() error
+
+	// stats returns the traffic statistics of the proxy.
+	stats() ([]proxyStats, error)
+}
+
+// endpointUpdater is implemented by backends that can apply endpoint changes
+// to the running proxy without a reload.
+type endpointUpdater interface {
+	// updateEndpoints applies the endpoints of the last accepted config to
+	// the running proxy. It returns an error if anything else changed, or
+	// the proxy refused the update, the proxy must be reloaded then.
+	updateEndpoints() error
+}
+
+// configAcceptor is implemented by backends that keep state about the
+// configs they render.
+type configAcceptor interface {
+	// accept is called once the last rendered config is on disk, ie: it
+	// wasn't a dry run and it passed validation.
+	accept()
+}
+
+// proxyStats are the traffic statistics of a single proxy backend, as far as
+// the proxy reports them.
+type proxyStats struct {
+	Name        string `json:"name"`
+	Requests    int64  `json:"requests"`
+	Errors      int64  `json:"errors"`
+	ServersUp   int    `json:"serversUp"`
+	ServersDown int    `json:"serversDown"`
+}
+
+// backendDefaults are used for the fields left empty in loadbalancer.json.
+type backendDefaults struct {
+	template  string
+	config    string
+	reloadCmd string
+}
+
+// backendFactory creates a backend from the given config.
+type backendFactory func(cfg *loadBalancerConfig) loadBalancerBackend
+
+// backends maps the names accepted in loadbalancer.json to their factories.
+var backends = map[string]struct {
+	defaults backendDefaults
+	factory  backendFactory
+}{
+	"haproxy": {
+		backendDefaults{"template.cfg", "/etc/haproxy/haproxy.cfg", "./haproxy_reload"},
+		newHaproxyBackend,
+	},
+	"nginx": {
+		backendDefaults{"nginx.tmpl", "/etc/nginx/nginx.conf", "./nginx_reload"},
+		newNginxBackend,
+	},
+}
+
+// newLoadBalancerBackend fills in the defaults of the backend named in the
+// given config and creates it.
+func newLoadBalancerBackend(cfg *loadBalancerConfig) (loadBalancerBackend, error) {
+	b, ok := backends[cfg.Name]
+	if !ok {
+		names := []string{}
+		for name := range backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown loadbalancer %q, must be one of %v", cfg.Name, names)
+	}
+	if cfg.Template == "" {
+		cfg.Template = b.defaults.template
+	}
+	if cfg.Config == "" {
+		cfg.Config = b.defaults.config
+	}
+	if cfg.ReloadCmd == "" {
+		cfg.ReloadCmd = b.defaults.reloadCmd
+	}
+	return b.factory(cfg), nil
+}
+
+// commandBackend implements the parts shared by all backends: rendering a go
+// template, and validating and reloading by running the commands specified
+// in loadbalancer.json.
+type commandBackend struct {
+	cfg   *loadBalancerConfig
+	funcs template.FuncMap
+}
+
+// renderTemplate executes the configured template with the given data.
+func (b *commandBackend) renderTemplate(w io.Writer, data interface{}) error {
+	// ParseFiles names the template after the base name of the file.
+	t, err := template.New(filepath.Base(b.cfg.Template)).Funcs(b.funcs).ParseFiles(b.cfg.Template)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, data)
+}
+
+// validate runs the validateCmd specified in the json manifest against the
+// config at the given path. A no-op if there is no validateCmd.
+func (b *commandBackend) validate(path string) error {
+	if b.cfg.ValidateCmd == "" {
+		return nil
+	}
+	output, err := exec.Command("sh", "-c", fmt.Sprintf("%v %v", b.cfg.ValidateCmd, path)).CombinedOutput()
+	if err != nil {
+		return &configValidationError{
+			name:     b.cfg.Name,
+			rejected: b.cfg.Config + ".rejected",
+			output:   string(output),
+			err:      err,
+		}
+	}
+	return nil
+}
+
+// reload reloads the loadbalancer using the reload cmd specified in the json manifest.
+func (b *commandBackend) reload() (string, error) {
+	output, err := exec.Command("sh", "-c", b.cfg.ReloadCmd).CombinedOutput()
+	msg := fmt.Sprintf("%v -- %v", b.cfg.Name, string(output))
+	if err != nil {
+		return string(output), fmt.Errorf("Error restarting %v: %v", msg, err)
+	}
+	glog.Info(msg)
+	return string(output), nil
+}
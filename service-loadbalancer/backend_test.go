@@ -0,0 +1,272 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/util"
+)
+
+// testServices returns a set of services exercising all template features.
+func testServices() map[string][]service {
+	return map[string][]service{
+		"httpServices": {
+			{Name: "api", Path: "/", Hosts: []string{"api.example.com"}, Ep: []string{"1.2.3.4:80"}, FrontendPort: 80,
+				Algorithm: "source", TimeoutServer: 60000,
+				HealthCheck: &healthCheck{Path: "/ready", Port: 8081, Interval: 2000, Timeout: 3000, Rise: 2, Fall: 3}},
+			{Name: "web:8080", Path: "/web:8080", Ep: []string{"1.2.3.5:8080", "1.2.3.6:8080"}, FrontendPort: 80,
+				Algorithm: "roundrobin", CookieStickySession: true, ForwardedHeaders: true,
+				AllowCIDRs: []string{"10.0.0.0/8"}, DenyCIDRs: []string{"10.1.0.0/16"}, RateLimit: 20},
+		},
+		"httpsServices": {
+			{Name: "api", Path: "/", Hosts: []string{"api.example.com"}, Ep: []string{"1.2.3.4:80"}, FrontendPort: 443, SslCert: "/etc/certs/api.pem"},
+		},
+		"tcpServices": {
+			{Name: "mysql:3306", Ep: []string{"1.2.3.7:3306"}, FrontendPort: 3306, Algorithm: "leastconn",
+				Weights: map[string]int{"1.2.3.7:3306": 256}, SendProxy: "v2",
+				AllowCIDRs: []string{"10.0.0.0/8"}, RateLimit: 5},
+		},
+	}
+}
+
+func TestNewLoadBalancerBackend(t *testing.T) {
+	for name, defaults := range map[string]string{
+		"haproxy": "template.cfg",
+		"nginx":   "nginx.tmpl",
+	} {
+		cfg := &loadBalancerConfig{Name: name}
+		if _, err := newLoadBalancerBackend(cfg); err != nil {
+			t.Errorf("Unexpected error creating %v backend: %v", name, err)
+		}
+		if cfg.Template != defaults || cfg.Config == "" || cfg.ReloadCmd == "" {
+			t.Errorf("Expected %v defaults to be filled in, got %+v", name, cfg)
+		}
+	}
+	if _, err := newLoadBalancerBackend(&loadBalancerConfig{Name: "f5"}); err == nil {
+		t.Errorf("Expected an error for an unknown backend")
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	for name, expected := range map[string][]string{
+		"haproxy": {
+			"acl host_api hdr(host) -i api.example.com api.example.com:80",
+			"bind *:443 ssl crt /etc/certs/api.pem",
+			"server web:8080_1 1.2.3.6:8080 cookie web:8080_1",
+			"server web:8080_3 127.0.0.1:1 disabled cookie web:8080_3",
+			"balance source",
+			"timeout server 60000",
+			"bind *:3306",
+			"balance leastconn",
+			"option httpchk GET /ready",
+			"timeout check 3000",
+			"server api_0 1.2.3.4:80 check inter 2000 rise 2 fall 3 port 8081",
+			"server mysql:3306_0 1.2.3.7:3306 weight 256 send-proxy-v2",
+			"option forwardfor",
+			"http-request deny if { src 10.1.0.0/16 }",
+			"http-request deny if !{ src 10.0.0.0/8 }",
+			"http-request deny if { sc_http_req_rate(0) gt 20 }",
+			"tcp-request content reject if !{ src 10.0.0.0/8 }",
+			"tcp-request content reject if { sc_conn_rate(0) gt 5 }",
+		},
+		"nginx": {
+			"upstream web_8080 {",
+			"server_name api.example.com;",
+			"listen 80 default_server;",
+			"ssl_certificate /etc/certs/api.pem;",
+			"proxy_pass http://web_8080;",
+			"listen 3306;",
+			"ip_hash;",
+			"least_conn;",
+			"proxy_read_timeout 60000ms;",
+			"server 1.2.3.4:80 max_fails=3 fail_timeout=2000ms;",
+			"server 1.2.3.7:3306 weight=256;",
+			"proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;",
+			"proxy_protocol on;",
+			"limit_req_zone $binary_remote_addr zone=web_8080:10m rate=20r/s;",
+			"deny 10.1.0.0/16;\n            allow 10.0.0.0/8;\n            deny all;",
+			"limit_req zone=web_8080 burst=20 nodelay;",
+			"limit_conn mysql_3306 5;",
+		},
+	} {
+		cfg := &loadBalancerConfig{Name: name}
+		b, err := newLoadBalancerBackend(cfg)
+		if err != nil {
+			t.Fatalf("Unexpected error creating %v backend: %v", name, err)
+		}
+		var rendered bytes.Buffer
+		if err := b.render(&rendered, testServices()); err != nil {
+			t.Fatalf("Unexpected error rendering %v: %v", cfg.Template, err)
+		}
+		for _, line := range expected {
+			if !strings.Contains(rendered.String(), line) {
+				t.Errorf("Expected %v to contain %q, got:\n%v", cfg.Template, line, rendered.String())
+			}
+		}
+	}
+}
+
+func TestRenderAcceptProxy(t *testing.T) {
+	*acceptProxy = true
+	defer func() { *acceptProxy = false }()
+	for name, expected := range map[string][]string{
+		"haproxy": {"bind *:80 accept-proxy", "crt /etc/certs/api.pem accept-proxy", "bind *:3306 accept-proxy"},
+		"nginx":   {"real_ip_header proxy_protocol;", "listen 80 default_server proxy_protocol;", "listen 3306 proxy_protocol;"},
+	} {
+		cfg := &loadBalancerConfig{Name: name}
+		b, err := newLoadBalancerBackend(cfg)
+		if err != nil {
+			t.Fatalf("Unexpected error creating %v backend: %v", name, err)
+		}
+		var rendered bytes.Buffer
+		if err := b.render(&rendered, testServices()); err != nil {
+			t.Fatalf("Unexpected error rendering %v: %v", cfg.Template, err)
+		}
+		for _, line := range expected {
+			if !strings.Contains(rendered.String(), line) {
+				t.Errorf("Expected %v to contain %q, got:\n%v", cfg.Template, line, rendered.String())
+			}
+		}
+	}
+}
+
+func TestGroupNginxServers(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		services []service
+		// expected holds the host, certificate and service names of each server.
+		expected [][]string
+	}{
+		{
+			desc: "default server",
+			services: []service{
+				{Name: "a", Hosts: []string{"foo.com"}},
+				{Name: "b"},
+				{Name: "c", Hosts: []string{"foo.com"}},
+			},
+			expected: [][]string{{"foo.com", "", "a", "c"}, {"", "", "b"}},
+		},
+		{
+			desc: "overlapping hosts",
+			services: []service{
+				{Name: "x", Hosts: []string{"a.com"}},
+				{Name: "y", Hosts: []string{"a.com", "b.com"}},
+			},
+			expected: [][]string{{"a.com", "", "x", "y"}, {"b.com", "", "y"}},
+		},
+		{
+			desc: "conflicting certificates",
+			services: []service{
+				{Name: "x", Hosts: []string{"a.com"}, SslCert: "/x.pem"},
+				{Name: "y", Hosts: []string{"a.com", "b.com"}, SslCert: "/y.pem"},
+				{Name: "z", SslCert: "/z.pem"},
+				{Name: "w", SslCert: "/w.pem"},
+			},
+			expected: [][]string{{"a.com", "/x.pem", "x"}, {"b.com", "/y.pem", "y"}, {"", "/z.pem", "z"}},
+		},
+	}
+	for _, tc := range testCases {
+		got := [][]string{}
+		for _, server := range groupNginxServers(tc.services) {
+			names := []string{server.Host, server.SslCert}
+			for _, s := range server.Services {
+				names = append(names, s.Name)
+			}
+			got = append(got, names)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%v: expected servers %v, got %v", tc.desc, tc.expected, got)
+		}
+	}
+}
+
+func TestParseHaproxyStats(t *testing.T) {
+	csv := `# pxname,svname,qcur,qmax,scur,smax,slim,stot,bin,bout,dreq,dresp,ereq,econ,eresp,wretr,wredis,status,
+stats,FRONTEND,,,1,1,2000,5,0,0,0,0,0,,,,,OPEN,
+httpfrontend,FRONTEND,,,0,1,2000,10,0,0,0,0,2,,,,,OPEN,
+web,web_0,0,0,0,1,,6,0,0,,0,,1,0,0,0,UP,
+web,web_1,0,0,0,1,,4,0,0,,0,,0,2,0,0,DOWN,
+web,web_2,0,0,0,0,,0,0,0,,0,,0,0,0,0,MAINT,
+web,web_3,0,0,0,0,,0,0,0,,0,,0,0,0,0,MAINT,
+web,BACKEND,0,0,0,1,200,10,0,0,0,0,,1,2,0,0,UP,
+`
+	// web_3 is a free slot, web_2 an endpoint in maintenance.
+	stats, err := parseHaproxyStats(strings.NewReader(csv), util.NewStringSet("web/web_3"))
+	if err != nil {
+		t.Fatalf("Unexpected error parsing stats: %v", err)
+	}
+	expected := []proxyStats{{Name: "web", Requests: 10, Errors: 3, ServersUp: 1, ServersDown: 2}}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
+
+// fakeHaproxySocket serves a single connection on a unix socket in dir,
+// replying with the given response. The command received is sent on the
+// returned channel.
+func fakeHaproxySocket(t *testing.T, dir, response string) (string, chan string) {
+	socket := filepath.Join(dir, "haproxy.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Unexpected error listening on %v: %v", socket, err)
+	}
+	commands := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		cmd, _ := bufio.NewReader(conn).ReadString('\n')
+		commands <- cmd
+		conn.Write([]byte(response))
+	}()
+	return socket, commands
+}
+
+func TestHaproxySocketStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	socket, commands := fakeHaproxySocket(t, dir,
+		"# pxname,svname,stot,econ,eresp,status,\nweb,web_0,6,0,0,UP,\nweb,BACKEND,6,0,1,UP,\n\n")
+
+	h := &haproxyBackend{statsSocket: socket}
+	stats, err := h.stats()
+	if err != nil {
+		t.Fatalf("Unexpected error reading stats: %v", err)
+	}
+	if cmd := <-commands; cmd != "show stat\n" {
+		t.Errorf("Expected show stat, got %q", cmd)
+	}
+	expected := []proxyStats{{Name: "web", Requests: 6, Errors: 1, ServersUp: 1}}
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Expected %+v, got %+v", expected, stats)
+	}
+}
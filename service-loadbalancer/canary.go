@@ -0,0 +1,156 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// lbCanaryOfKey is the service annotation naming the service, in the
+	// same namespace, this service is a canary of. A canary has no route of
+	// its own, its endpoints are added to the backends of the primary.
+	lbCanaryOfKey = "serviceloadbalancer/lb.canary-of"
+
+	// lbCanaryWeightKey is the service annotation holding the percentage of
+	// the traffic of the primary a canary receives, from 0 to 100.
+	lbCanaryWeightKey = "serviceloadbalancer/lb.canary-weight"
+
+	// maxEndpointWeight is the weight of an endpoint receiving all the
+	// traffic of a service, haproxy server weights go up to 256.
+	maxEndpointWeight = 256
+)
+
+// canary is a service receiving a share of the traffic of another service.
+type canary struct {
+	s       *api.Service
+	primary string
+	weight  int
+}
+
+// getCanaries returns the canaries among the given services, keyed by the
+// namespace/name of their primary. Canaries with invalid annotations are
+// reported and loadbalanced like any other service. Canaries are considered
+// in name order, so the same ones are rejected every sync if their weights
+// add up to more than 100.
+func (lbc *loadBalancerController) getCanaries(services []api.Service) map[string][]canary {
+	byName := map[string]*api.Service{}
+	names := []string{}
+	for i := range services {
+		key := fmt.Sprintf("%v/%v", services[i].Namespace, services[i].Name)
+		byName[key] = &services[i]
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	canaries := map[string][]canary{}
+	total := map[string]int{}
+	for _, name := range names {
+		s := byName[name]
+		primary, ok := s.Annotations[lbCanaryOfKey]
+		if !ok {
+			continue
+		}
+		value, ok := s.Annotations[lbCanaryWeightKey]
+		if !ok {
+			lbc.reportInvalidAnnotation(s, lbCanaryOfKey, primary,
+				fmt.Errorf("canaries need a %v annotation", lbCanaryWeightKey))
+			continue
+		}
+		weight, err := strconv.Atoi(value)
+		if err == nil && (weight < 0 || weight > 100) {
+			err = fmt.Errorf("must be between 0 and 100")
+		}
+		if err != nil {
+			lbc.reportInvalidAnnotation(s, lbCanaryWeightKey, value, err)
+			continue
+		}
+		key := fmt.Sprintf("%v/%v", s.Namespace, primary)
+		p, ok := byName[key]
+		switch {
+		case !ok:
+			err = fmt.Errorf("no service %v in namespace %v", primary, s.Namespace)
+		case p == s:
+			err = fmt.Errorf("a service can't be a canary of itself")
+		case p.Annotations[lbCanaryOfKey] != "":
+			err = fmt.Errorf("%v is a canary itself", primary)
+		case total[key]+weight > 100:
+			err = fmt.Errorf("the canaries of %v would get more than 100%% of its traffic", primary)
+		}
+		if err != nil {
+			lbc.reportInvalidAnnotation(s, lbCanaryOfKey, primary, err)
+			continue
+		}
+		total[key] += weight
+		canaries[key] = append(canaries[key], canary{s: s, primary: primary, weight: weight})
+	}
+	return canaries
+}
+
+// addCanaries adds the endpoints of the canaries of a service port to the
+// endpoints of the port, and returns them with their weights. The weights
+// split the traffic between the primary and each canary as annotated, and
+// evenly across the endpoints of each. Canaries need a port with the same
+// number. Returns nil weights if there are no canaries.
+func (lbc *loadBalancerController) addCanaries(servicePort *api.ServicePort, ep []string, canaries []canary) ([]string, map[string]int) {
+	if len(canaries) == 0 {
+		return ep, nil
+	}
+	eps := []string{}
+	weights := map[string]int{}
+	add := func(ep []string, share int) {
+		if share == 0 {
+			return
+		}
+		for _, e := range ep {
+			weight := share * maxEndpointWeight / 100 / len(ep)
+			if weight < 1 {
+				weight = 1
+			}
+			if _, ok := weights[e]; !ok {
+				eps = append(eps, e)
+			}
+			weights[e] += weight
+		}
+	}
+
+	share := 100
+	for _, c := range canaries {
+		share -= c.weight
+	}
+	add(ep, share)
+	for _, c := range canaries {
+		found := false
+		for i := range c.s.Spec.Ports {
+			port := &c.s.Spec.Ports[i]
+			if port.Port == servicePort.Port && protocolOrTCP(port.Protocol) == protocolOrTCP(servicePort.Protocol) {
+				add(lbc.getServiceEndpoints(c.s, port), c.weight)
+				found = true
+				break
+			}
+		}
+		if !found {
+			glog.Infof("Canary %v of %v has no port %v", c.s.Name, c.primary, servicePort.Port)
+		}
+	}
+	return eps, weights
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+func TestGetServicesCanary(t *testing.T) {
+	testCases := []struct {
+		annotations map[string]string
+		weights     map[string]int
+		invalid     bool
+	}{
+		{
+			annotations: map[string]string{lbCanaryOfKey: "web-v1", lbCanaryWeightKey: "10"},
+			weights:     map[string]int{"1.2.3.4:8080": 115, "1.2.3.5:8080": 115, "1.2.3.6:8080": 25},
+		},
+		{
+			annotations: map[string]string{lbCanaryOfKey: "web-v1", lbCanaryWeightKey: "100"},
+			weights:     map[string]int{"1.2.3.6:8080": 256},
+		},
+		{
+			annotations: map[string]string{lbCanaryOfKey: "web-v1", lbCanaryWeightKey: "0"},
+			weights:     map[string]int{"1.2.3.4:8080": 128, "1.2.3.5:8080": 128},
+		},
+		{
+			annotations: map[string]string{lbCanaryOfKey: "web-v1", lbCanaryWeightKey: "110"},
+			invalid:     true,
+		},
+		{
+			annotations: map[string]string{lbCanaryOfKey: "web-v1"},
+			invalid:     true,
+		},
+		{
+			annotations: map[string]string{lbCanaryOfKey: "web-v0", lbCanaryWeightKey: "10"},
+			invalid:     true,
+		},
+	}
+
+	for _, tc := range testCases {
+		v1 := getService([]api.ServicePort{{Port: 80, TargetPort: util.NewIntOrStringFromInt(8080)}})
+		v1.Name = "web-v1"
+		v2 := getService([]api.ServicePort{{Port: 80, TargetPort: util.NewIntOrStringFromInt(8080)}})
+		v2.Name = "web-v2"
+		v2.Annotations = tc.annotations
+		endpoints := []*api.Endpoints{
+			getEndpoints(v1, []api.EndpointAddress{{IP: "1.2.3.4"}, {IP: "1.2.3.5"}}, []api.EndpointPort{{Port: 8080}}),
+			getEndpoints(v2, []api.EndpointAddress{{IP: "1.2.3.6"}}, []api.EndpointPort{{Port: 8080}}),
+		}
+		flb := newFakeLoadBalancerController(endpoints, []*api.Service{v1, v2})
+		http, _, _ := flb.getServices()
+
+		routes := map[string]map[string]int{}
+		for _, svc := range http {
+			routes[svc.Name] = svc.Weights
+		}
+		expected := map[string]map[string]int{"web-v1": tc.weights}
+		if tc.invalid {
+			// An invalid canary is routed like any other service.
+			expected = map[string]map[string]int{"web-v1": nil, "web-v2": nil}
+		}
+		if !reflect.DeepEqual(routes, expected) {
+			t.Errorf("Expected routes %v for %v, got %v", expected, tc.annotations, routes)
+		}
+		if events := flb.recorder.(*fakeEventRecorder).events; tc.invalid != (len(events) != 0) {
+			t.Errorf("Unexpected events for %v: %v", tc.annotations, events)
+		}
+	}
+}
+
+func TestGetCanariesTooHeavy(t *testing.T) {
+	primary := api.Service{ObjectMeta: api.ObjectMeta{Name: "web", Namespace: ns}}
+	services := []api.Service{primary}
+	for _, name := range []string{"b", "a", "c"} {
+		services = append(services, api.Service{ObjectMeta: api.ObjectMeta{Name: name, Namespace: ns,
+			Annotations: map[string]string{lbCanaryOfKey: "web", lbCanaryWeightKey: "40"}}})
+	}
+	flb := newFakeLoadBalancerController(nil, nil)
+	canaries := flb.getCanaries(services)[ns+"/web"]
+	names := []string{}
+	for _, c := range canaries {
+		names = append(names, c.s.Name)
+	}
+	if expected := []string{"a", "b"}; !reflect.DeepEqual(names, expected) {
+		t.Errorf("Expected canaries %v, got %v", expected, names)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// debugConfig is what the healthz server reports under /debug/config.
+type debugConfig struct {
+	// Config is the last rendered config, it might have been rejected.
+	Config     string    `json:"config"`
+	RenderTime time.Time `json:"renderTime"`
+
+	// ReloadOutput and ReloadError are the output and error of the last
+	// reload of the loadbalancer.
+	ReloadOutput string    `json:"reloadOutput"`
+	ReloadError  string    `json:"reloadError,omitempty"`
+	ReloadTime   time.Time `json:"reloadTime"`
+
+	// SyncError is the last error returned by a sync, it's kept after
+	// later syncs succeed.
+	SyncError     string    `json:"syncError,omitempty"`
+	SyncErrorTime time.Time `json:"syncErrorTime"`
+	LastSyncTime  time.Time `json:"lastSyncTime"`
+}
+
+// debugState keeps the state of a running controller for the healthz server,
+// what --dry prints is only available after the fact in the logs otherwise.
+type debugState struct {
+	lock     sync.Mutex
+	services map[string][]service
+	config   debugConfig
+}
+
+// debug is the state served under /debug, like the metrics it's recorded
+// by the controller as it goes.
+var debug = &debugState{services: map[string][]service{}}
+
+// recordServices records the services of the last sync, keyed like the maps
+// passed to the templates.
+func (d *debugState) recordServices(services map[string][]service) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.services = services
+}
+
+// recordConfig records a rendered config.
+func (d *debugState) recordConfig(rendered []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.config.Config = string(rendered)
+	d.config.RenderTime = time.Now()
+}
+
+// recordReload records the output and result of a reload.
+func (d *debugState) recordReload(output string, err error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.config.ReloadOutput = output
+	d.config.ReloadError = ""
+	if err != nil {
+		d.config.ReloadError = err.Error()
+	}
+	d.config.ReloadTime = time.Now()
+}
+
+// recordSync records the result of a sync, deferred syncs are ignored.
+func (d *debugState) recordSync(err error) {
+	if err == deferredSync {
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.config.LastSyncTime = time.Now()
+	if err != nil {
+		d.config.SyncError = err.Error()
+		d.config.SyncErrorTime = d.config.LastSyncTime
+	}
+}
+
+// serveServices writes the services of the last sync as json.
+func (d *debugState) serveServices(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.services)
+}
+
+// serveConfig writes the debugConfig as json.
+func (d *debugState) serveConfig(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d.config)
+}
@@ -0,0 +1,63 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDebugState(t *testing.T) {
+	d := &debugState{}
+	services := map[string][]service{
+		"httpServices": {{Name: "web:80", Ep: []string{"1.2.3.4:8080"}, Path: "/web", FrontendPort: 80}},
+		"tcpServices":  {{Name: "mysql:3306", Ep: []string{"1.2.3.5:3306"}, FrontendPort: 3306}},
+	}
+	d.recordServices(services)
+	d.recordConfig([]byte("frontend httpfrontend"))
+	d.recordReload("reloaded", nil)
+	d.recordSync(fmt.Errorf("no endpoints"))
+	d.recordSync(deferredSync)
+	d.recordSync(nil)
+
+	w := httptest.NewRecorder()
+	d.serveServices(w, nil)
+	got := map[string][]service{}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Invalid /debug/services response %v: %v", w.Body.String(), err)
+	}
+	if !reflect.DeepEqual(got, services) {
+		t.Errorf("Expected services %+v, got %+v", services, got)
+	}
+
+	w = httptest.NewRecorder()
+	d.serveConfig(w, nil)
+	var cfg debugConfig
+	if err := json.Unmarshal(w.Body.Bytes(), &cfg); err != nil {
+		t.Fatalf("Invalid /debug/config response %v: %v", w.Body.String(), err)
+	}
+	if cfg.Config != "frontend httpfrontend" || cfg.ReloadOutput != "reloaded" || cfg.ReloadError != "" {
+		t.Errorf("Expected the rendered config and reload output, got %+v", cfg)
+	}
+	// The last error is kept after a successful sync.
+	if cfg.SyncError != "no endpoints" || cfg.LastSyncTime.Before(cfg.SyncErrorTime) {
+		t.Errorf("Expected the last sync error, got %+v", cfg)
+	}
+}
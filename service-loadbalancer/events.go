@@ -0,0 +1,119 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client"
+	"k8s.io/kubernetes/pkg/types"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+// eventRecorder records events about services. It is the subset of the
+// client/record package the controller needs, that package depends on a
+// cache we don't vendor.
+type eventRecorder interface {
+	Eventf(s *api.Service, reason, messageFmt string, args ...interface{})
+}
+
+// eventf records an event about a service found while syncing, as long as
+// this replica is the leader. Like status writes, this keeps the replicas
+// from each reporting the same problems.
+func (lbc *loadBalancerController) eventf(s *api.Service, reason, messageFmt string, args ...interface{}) {
+	if lbc.isLeader() {
+		lbc.recorder.Eventf(s, reason, messageFmt, args...)
+	}
+}
+
+// apiEventRecorder creates events through the apiserver. Since the controller
+// looks at every service on each sync, the same event is only created once
+// per version of the service. Only the events of the latest version of each
+// service are remembered, and they are forgotten when the service is deleted.
+type apiEventRecorder struct {
+	client   client.EventNamespacer
+	source   api.EventSource
+	lock     sync.Mutex
+	recorded map[types.UID]*recordedEvents
+}
+
+// recordedEvents are the events created for a version of a service.
+type recordedEvents struct {
+	resourceVersion string
+	events          util.StringSet
+}
+
+func newAPIEventRecorder(kubeClient client.EventNamespacer) *apiEventRecorder {
+	return &apiEventRecorder{
+		client:   kubeClient,
+		source:   api.EventSource{Component: "service-loadbalancer"},
+		recorded: map[types.UID]*recordedEvents{},
+	}
+}
+
+// forget drops the events recorded for the given service.
+func (r *apiEventRecorder) forget(s *api.Service) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.recorded, s.UID)
+}
+
+func (r *apiEventRecorder) Eventf(s *api.Service, reason, messageFmt string, args ...interface{}) {
+	message := fmt.Sprintf(messageFmt, args...)
+	key := fmt.Sprintf("%v/%v", reason, message)
+	r.lock.Lock()
+	recorded, ok := r.recorded[s.UID]
+	if !ok || recorded.resourceVersion != s.ResourceVersion {
+		recorded = &recordedEvents{resourceVersion: s.ResourceVersion, events: util.NewStringSet()}
+		r.recorded[s.UID] = recorded
+	}
+	if recorded.events.Has(key) {
+		r.lock.Unlock()
+		return
+	}
+	recorded.events.Insert(key)
+	r.lock.Unlock()
+
+	ref, err := api.GetReference(s)
+	if err != nil {
+		glog.Errorf("Unable to record event %v for service %v/%v: %v", reason, s.Namespace, s.Name, err)
+		return
+	}
+	now := util.Now()
+	event := &api.Event{
+		ObjectMeta: api.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", s.Name, time.Now().UnixNano()),
+			Namespace: s.Namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		Source:         r.source,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	go func() {
+		if _, err := r.client.Events(s.Namespace).Create(event); err != nil {
+			glog.Errorf("Unable to record event %v for service %v/%v: %v", reason, s.Namespace, s.Name, err)
+		}
+	}()
+}
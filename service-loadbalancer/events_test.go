@@ -0,0 +1,77 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/testclient"
+)
+
+func TestAPIEventRecorderRemembersLatestVersion(t *testing.T) {
+	r := newAPIEventRecorder(testclient.NewSimpleFake())
+	s := &api.Service{ObjectMeta: api.ObjectMeta{Name: "web", Namespace: ns, UID: "web-uid", ResourceVersion: "1"}}
+	recorded := func() int {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.recorded[s.UID] == nil {
+			return 0
+		}
+		return r.recorded[s.UID].events.Len()
+	}
+
+	r.Eventf(s, invalidAnnotationReason, "invalid %v", "a")
+	r.Eventf(s, invalidAnnotationReason, "invalid %v", "a")
+	r.Eventf(s, invalidAnnotationReason, "invalid %v", "b")
+	if n := recorded(); n != 2 {
+		t.Errorf("Expected 2 events for version 1, got %v", n)
+	}
+
+	// A new version of the service starts over.
+	s.ResourceVersion = "2"
+	r.Eventf(s, invalidAnnotationReason, "invalid %v", "a")
+	if n := recorded(); n != 1 {
+		t.Errorf("Expected 1 event for version 2, got %v", n)
+	}
+
+	r.forget(s)
+	if len(r.recorded) != 0 {
+		t.Errorf("Expected no events to be remembered for deleted services, got %v", r.recorded)
+	}
+}
+
+func TestEventsOnlyFromLeader(t *testing.T) {
+	flb := newFakeLoadBalancerController(nil, nil)
+	s := &api.Service{ObjectMeta: api.ObjectMeta{Name: "web", Namespace: ns}}
+	leader := false
+	flb.isLeader = func() bool { return leader }
+
+	flb.reportInvalidAnnotation(s, lbPathKey, "web", fmt.Errorf("invalid"))
+	flb.rejectTCPService(&tcpCandidate{s: *s}, "port 80 is taken")
+	if events := flb.recorder.(*fakeEventRecorder).events; len(events) != 0 {
+		t.Errorf("Expected no events from a follower, got %v", events)
+	}
+
+	leader = true
+	flb.reportInvalidAnnotation(s, lbPathKey, "web", fmt.Errorf("invalid"))
+	flb.rejectTCPService(&tcpCandidate{s: *s}, "port 80 is taken")
+	if events := flb.recorder.(*fakeEventRecorder).events; len(events) != 2 {
+		t.Errorf("Expected 2 events from the leader, got %v", events)
+	}
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+const (
+	// lbExternalNameKey is the service annotation holding the dns name of
+	// an endpoint outside the cluster. The loadbalancer forwards traffic
+	// for all ports of the service to that name, resolved by the proxy.
+	lbExternalNameKey = "serviceloadbalancer/lb.external-name"
+
+	// Reasons of the events explaining how a service is loadbalanced.
+	headlessServiceReason = "HeadlessService"
+	externalServiceReason = "ExternalService"
+	noEndpointsReason     = "NoEndpoints"
+)
+
+// isHeadless returns true if the service has no cluster ip to forward to.
+func isHeadless(s *api.Service) bool {
+	return s.Spec.ClusterIP == "" || s.Spec.ClusterIP == api.ClusterIPNone
+}
+
+// getExternalName returns the external name of the given service, if it has
+// a valid one.
+func (lbc *loadBalancerController) getExternalName(s *api.Service) (string, bool) {
+	name, ok := s.Annotations[lbExternalNameKey]
+	if !ok {
+		return "", false
+	}
+	if !util.IsDNS1123Subdomain(name) && net.ParseIP(name) == nil {
+		lbc.reportInvalidAnnotation(s, lbExternalNameKey, name,
+			fmt.Errorf("must be a dns name or an ip"))
+		return "", false
+	}
+	return name, true
+}
+
+// getServiceEndpoints returns the endpoints to balance a service port across:
+// the external name of external services, the cluster ip with
+// --forward-services, or the endpoints of the service. Headless services
+// have no cluster ip, so they are always balanced across their endpoints.
+// Each case is recorded as an event on the service.
+func (lbc *loadBalancerController) getServiceEndpoints(s *api.Service, servicePort *api.ServicePort) []string {
+	if name, ok := lbc.getExternalName(s); ok {
+		// External endpoints listen on the target port, if it's a
+		// number, there are no pods to resolve a named port.
+		port := servicePort.Port
+		if servicePort.TargetPort.Kind == util.IntstrInt && servicePort.TargetPort.IntVal != 0 {
+			port = servicePort.TargetPort.IntVal
+		}
+		lbc.eventf(s, externalServiceReason, "Forwarding port %v to %v:%v", servicePort.Port, name, port)
+		return []string{net.JoinHostPort(name, fmt.Sprintf("%v", port))}
+	}
+	if lbc.forwardServices {
+		if !isHeadless(s) {
+			return []string{fmt.Sprintf("%v:%v", s.Spec.ClusterIP, servicePort.Port)}
+		}
+		lbc.eventf(s, headlessServiceReason,
+			"Service is headless, balancing across its endpoints instead of its cluster ip")
+	}
+	ep := lbc.getEndpoints(s, servicePort)
+	if len(ep) == 0 {
+		lbc.eventf(s, noEndpointsReason, "Port %v has no endpoints, it is not loadbalanced", servicePort.Port)
+	}
+	return ep
+}
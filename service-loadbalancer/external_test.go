@@ -0,0 +1,100 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+func TestGetServiceEndpoints(t *testing.T) {
+	testCases := []struct {
+		clusterIP   string
+		annotations map[string]string
+		forward     bool
+		endpoints   bool
+		expected    []string
+		reason      string
+	}{
+		{
+			clusterIP: "10.0.0.1",
+			endpoints: true,
+			expected:  []string{"1.2.3.4:8080"},
+		},
+		{
+			clusterIP: "10.0.0.1",
+			forward:   true,
+			endpoints: true,
+			expected:  []string{"10.0.0.1:80"},
+		},
+		{
+			clusterIP: api.ClusterIPNone,
+			forward:   true,
+			endpoints: true,
+			expected:  []string{"1.2.3.4:8080"},
+			reason:    headlessServiceReason,
+		},
+		{
+			clusterIP: api.ClusterIPNone,
+			forward:   true,
+			reason:    noEndpointsReason,
+		},
+		{
+			clusterIP:   "10.0.0.1",
+			annotations: map[string]string{lbExternalNameKey: "db.example.com"},
+			forward:     true,
+			expected:    []string{"db.example.com:8080"},
+			reason:      externalServiceReason,
+		},
+		{
+			clusterIP:   "10.0.0.1",
+			annotations: map[string]string{lbExternalNameKey: "not a name"},
+			endpoints:   true,
+			expected:    []string{"1.2.3.4:8080"},
+			reason:      invalidAnnotationReason,
+		},
+	}
+
+	for _, tc := range testCases {
+		svc := getService([]api.ServicePort{{Port: 80, TargetPort: util.NewIntOrStringFromInt(8080)}})
+		svc.Spec.ClusterIP = tc.clusterIP
+		svc.Annotations = tc.annotations
+		endpoints := []*api.Endpoints{}
+		if tc.endpoints {
+			endpoints = append(endpoints, getEndpoints(svc,
+				[]api.EndpointAddress{{IP: "1.2.3.4"}}, []api.EndpointPort{{Port: 8080}}))
+		}
+		flb := newFakeLoadBalancerController(endpoints, []*api.Service{svc})
+		flb.forwardServices = tc.forward
+
+		ep := flb.getServiceEndpoints(svc, &svc.Spec.Ports[0])
+		if !reflect.DeepEqual(ep, tc.expected) {
+			t.Errorf("Expected endpoints %v for %+v, got %v", tc.expected, tc, ep)
+		}
+		events := flb.recorder.(*fakeEventRecorder).events
+		if tc.reason == "" && len(events) != 0 {
+			t.Errorf("Expected no events for %+v, got %v", tc, events)
+		}
+		if tc.reason != "" && (len(events) == 0 || !strings.HasPrefix(events[len(events)-1], tc.reason)) {
+			t.Errorf("Expected a %v event for %+v, got %v", tc.reason, tc, events)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"k8s.io/kubernetes/pkg/util"
+)
+
+const (
+	// haproxyStatsSocket is the unix socket of the haproxy runtime api, see
+	// the stats socket directive in template.cfg.
+	haproxyStatsSocket = "/tmp/haproxy"
+
+	// haproxySocketTimeout bounds the time a runtime api command can take.
+	haproxySocketTimeout = 5 * time.Second
+)
+
+// haproxyBackend configures haproxy. It renders the services straight into
+// the template, checks health through the haproxy stats page and reads stats
+// from the stats socket. Endpoint changes are applied through the stats
+// socket when possible, see updateEndpoints.
+type haproxyBackend struct {
+	*commandBackend
+	statsURL    string
+	statsSocket string
+
+	// pending is the last rendered config, rendered the last config written
+	// to disk and running the config haproxy runs. Each is nil until the
+	// first render, write and reload respectively.
+	pending  *haproxyConfig
+	rendered *haproxyConfig
+	running  *haproxyConfig
+
+	// freeLock guards freeSlots, the free server slots of the running
+	// config, which stats reads outside of syncs.
+	freeLock  sync.Mutex
+	freeSlots util.StringSet
+}
+
+func newHaproxyBackend(cfg *loadBalancerConfig) loadBalancerBackend {
+	h := &haproxyBackend{
+		commandBackend: &commandBackend{cfg: cfg},
+		statsURL:       fmt.Sprintf("http://localhost:%v", *statsPort),
+		statsSocket:    haproxyStatsSocket,
+	}
+	h.funcs = template.FuncMap{
+		"servers": h.servers,
+	}
+	return h
+}
+
+func (h *haproxyBackend) render(w io.Writer, services map[string][]service) error {
+	h.pending = newHaproxyConfig(services, h.rendered)
+	return h.renderTemplate(w, map[string]interface{}{
+		"httpServices":  services["httpServices"],
+		"httpsServices": services["httpsServices"],
+		"tcpServices":   services["tcpServices"],
+		"acceptProxy":   *acceptProxy,
+	})
+}
+
+// accept records that the pending config was written to disk, so it's the
+// one the next reload or endpoint update applies.
+func (h *haproxyBackend) accept() {
+	h.rendered = h.pending
+}
+
+// reload reloads haproxy with the last config written to disk.
+func (h *haproxyBackend) reload() (string, error) {
+	output, err := h.commandBackend.reload()
+	if err != nil {
+		return output, err
+	}
+	h.setRunning(h.rendered)
+	return output, nil
+}
+
+// healthz delegates a check to the haproxy stats service.
+func (h *haproxyBackend) healthz() error {
+	response, err := http.Get(h.statsURL)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		contents, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			return fmt.Errorf("haproxy stats returned %v, error reading response: %v", response.StatusCode, err)
+		}
+		return fmt.Errorf("haproxy stats returned %v: %v", response.StatusCode, string(contents))
+	}
+	return nil
+}
+
+// stats reads the csv stats from the haproxy stats socket. There is an entry
+// per haproxy backend.
+func (h *haproxyBackend) stats() ([]proxyStats, error) {
+	out, err := h.runtimeCommand("show stat")
+	if err != nil {
+		return nil, err
+	}
+	h.freeLock.Lock()
+	defer h.freeLock.Unlock()
+	return parseHaproxyStats(strings.NewReader(out), h.freeSlots)
+}
+
+// runtimeCommand runs a command over the haproxy stats socket and returns
+// its output. haproxy closes the connection after each command.
+func (h *haproxyBackend) runtimeCommand(cmd string) (string, error) {
+	conn, err := net.DialTimeout("unix", h.statsSocket, haproxySocketTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(haproxySocketTimeout))
+	if _, err := io.WriteString(conn, cmd+"\n"); err != nil {
+		return "", fmt.Errorf("error sending %q to haproxy: %v", cmd, err)
+	}
+	out, err := ioutil.ReadAll(conn)
+	if err != nil {
+		return "", fmt.Errorf("error reading the output of %q from haproxy: %v", cmd, err)
+	}
+	return string(out), nil
+}
+
+// parseHaproxyStats parses haproxy's csv stats, see section 9.1 of
+// http://cbonte.github.io/haproxy-dconv/configuration-1.5.html. The given
+// free server slots, as backend/server, are skipped: they are disabled, not
+// down.
+func parseHaproxyStats(r io.Reader, free util.StringSet) ([]proxyStats, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("empty haproxy stats")
+	}
+	// The header is a comment: # pxname,svname,...
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimPrefix(strings.TrimSpace(name), "# ")] = i
+	}
+	for _, name := range []string{"pxname", "svname", "stot", "econ", "eresp", "status"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("haproxy stats have no %v column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i := columns[name]; i < len(record) {
+			return record[i]
+		}
+		return ""
+	}
+	count := func(record []string, name string) int64 {
+		n, _ := strconv.ParseInt(field(record, name), 10, 64)
+		return n
+	}
+
+	index := map[string]int{}
+	stats := []proxyStats{}
+	for _, record := range records[1:] {
+		pxname, svname := field(record, "pxname"), field(record, "svname")
+		if svname == "FRONTEND" || pxname == "stats" || free.Has(pxname+"/"+svname) {
+			continue
+		}
+		if _, ok := index[pxname]; !ok {
+			index[pxname] = len(stats)
+			stats = append(stats, proxyStats{Name: pxname})
+		}
+		s := &stats[index[pxname]]
+		switch status := field(record, "status"); {
+		case svname == "BACKEND":
+			s.Requests = count(record, "stot")
+			s.Errors = count(record, "econ") + count(record, "eresp")
+		case strings.HasPrefix(status, "UP"):
+			s.ServersUp++
+		case strings.HasPrefix(status, "DOWN"), status == "MAINT":
+			s.ServersDown++
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,285 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/kubernetes/pkg/util"
+)
+
+const (
+	// haproxyMinServerSlots is the minimum number of server lines of a
+	// haproxy backend. Backends have spare, disabled, server lines so
+	// endpoints can be added through the runtime api without a reload.
+	haproxyMinServerSlots = 4
+
+	// haproxyFreeSlotAddr is the address of disabled server lines.
+	haproxyFreeSlotAddr = "127.0.0.1:1"
+)
+
+// haproxyRuntimeResponses are the prefixes of the non-empty responses of the
+// runtime api commands sent by updateEndpoints that don't mean failure.
+var haproxyRuntimeResponses = []string{
+	"IP changed from",
+	"no need to change the addr",
+	"port changed from",
+	"no need to change the port",
+}
+
+// haproxyServer is a server line of a haproxy backend.
+type haproxyServer struct {
+	Name string
+	Addr string
+	// Ready is false for free slots, which are disabled.
+	Ready bool
+	// Weight is the weight of the server, 0 means the haproxy default.
+	Weight int
+}
+
+// haproxyConfig is a rendered haproxy config, split into the services without
+// their endpoints, which need a reload to change, and the endpoints assigned
+// to the server slots of each backend, which can be changed at runtime.
+type haproxyConfig struct {
+	services map[string][]service
+	// slots holds the endpoint of each server line of a backend, "" for
+	// free slots.
+	slots map[string][]string
+	// weights holds the weight of each server line of a backend, 0 for
+	// the haproxy default.
+	weights map[string][]int
+}
+
+// newHaproxyConfig splits the given services into a haproxyConfig. Endpoints
+// keep the server slot they had in prev, if any, so updates only touch the
+// slots of the endpoints that changed.
+func newHaproxyConfig(services map[string][]service, prev *haproxyConfig) *haproxyConfig {
+	c := &haproxyConfig{
+		services: map[string][]service{},
+		slots:    map[string][]string{},
+		weights:  map[string][]int{},
+	}
+	for key, svcs := range services {
+		for _, svc := range svcs {
+			// https services share the backends of the http services.
+			if key != "httpsServices" {
+				var prevSlots []string
+				if prev != nil {
+					prevSlots = prev.slots[svc.Name]
+				}
+				c.slots[svc.Name] = assignServerSlots(prevSlots, svc.Ep)
+				weights := make([]int, len(c.slots[svc.Name]))
+				for i, ep := range c.slots[svc.Name] {
+					weights[i] = svc.Weights[ep]
+				}
+				c.weights[svc.Name] = weights
+			}
+			svc.Ep, svc.Weights = nil, nil
+			c.services[key] = append(c.services[key], svc)
+		}
+	}
+	return c
+}
+
+// assignServerSlots assigns the given endpoints to server slots. Endpoints
+// in prev keep their slot, new endpoints take the first free slots. The
+// number of slots is doubled when they run out, and never shrinks, so
+// scaling a service up and down doesn't need a reload.
+func assignServerSlots(prev []string, eps []string) []string {
+	n := len(prev)
+	if n < haproxyMinServerSlots {
+		n = haproxyMinServerSlots
+	}
+	for n < len(eps) {
+		n *= 2
+	}
+	want := util.NewStringSet(eps...)
+	assigned := util.NewStringSet()
+	slots := make([]string, n)
+	for i, ep := range prev {
+		if want.Has(ep) {
+			slots[i] = ep
+			assigned.Insert(ep)
+		}
+	}
+	free := 0
+	for _, ep := range eps {
+		if assigned.Has(ep) {
+			continue
+		}
+		for slots[free] != "" {
+			free++
+		}
+		slots[free] = ep
+		assigned.Insert(ep)
+	}
+	return slots
+}
+
+// sameStructure returns true if the two configs only differ in the
+// endpoints assigned to their server slots.
+func (c *haproxyConfig) sameStructure(other *haproxyConfig) bool {
+	if !reflect.DeepEqual(c.services, other.services) || len(c.slots) != len(other.slots) {
+		return false
+	}
+	for backend, slots := range c.slots {
+		if len(slots) != len(other.slots[backend]) {
+			return false
+		}
+	}
+	return true
+}
+
+// haproxyServerName returns the name of a server line of a backend.
+func haproxyServerName(backend string, slot int) string {
+	return fmt.Sprintf("%v_%v", backend, slot)
+}
+
+// servers returns the server lines of the given backend in the last
+// rendered config.
+func (h *haproxyBackend) servers(backend string) []haproxyServer {
+	servers := []haproxyServer{}
+	for i, ep := range h.pending.slots[backend] {
+		server := haproxyServer{
+			Name:   haproxyServerName(backend, i),
+			Addr:   ep,
+			Ready:  ep != "",
+			Weight: h.pending.weights[backend][i],
+		}
+		if !server.Ready {
+			server.Addr = haproxyFreeSlotAddr
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// updateEndpoints points the server slots of the running haproxy at the
+// endpoints of the last rendered config through the runtime api, so
+// endpoint changes don't drop connections with a reload. Freed slots are put
+// in maintenance, and the weights of canaries, and of endpoints moving into a
+// slot, are updated. Returns an error if the rendered config differs from the
+// running one in more than endpoints, or haproxy refuses a command, in which
+// case the caller should reload.
+func (h *haproxyBackend) updateEndpoints() error {
+	if h.running == nil || h.rendered == nil || !h.rendered.sameStructure(h.running) {
+		return fmt.Errorf("haproxy config changed beyond endpoints")
+	}
+	cmds := []string{}
+	for backend, slots := range h.rendered.slots {
+		for i, ep := range slots {
+			server := fmt.Sprintf("%v/%v", backend, haproxyServerName(backend, i))
+			weight, running := haproxyWeight(h.rendered.weights[backend][i]), haproxyWeight(h.running.weights[backend][i])
+			moved := ep != h.running.slots[backend][i]
+			// Free slots keep the weight of their last endpoint in haproxy, so
+			// endpoints taking a slot always set their own.
+			if ep != "" && (weight != running || moved) {
+				cmds = append(cmds, fmt.Sprintf("set weight %v %v", server, weight))
+			}
+			if !moved {
+				continue
+			}
+			if ep == "" {
+				cmds = append(cmds, fmt.Sprintf("set server %v state maint", server))
+				continue
+			}
+			host, port, err := net.SplitHostPort(ep)
+			if err != nil {
+				return err
+			}
+			// The runtime api takes ips, haproxy resolves names on reload.
+			if net.ParseIP(host) == nil {
+				return fmt.Errorf("%v is not an ip", host)
+			}
+			cmds = append(cmds,
+				fmt.Sprintf("set server %v addr %v port %v", server, host, port),
+				fmt.Sprintf("set server %v state ready", server))
+		}
+	}
+	if len(cmds) == 0 {
+		h.setRunning(h.rendered)
+		return nil
+	}
+	// Apply the commands in a stable order, it makes the logs readable.
+	sort.Strings(cmds)
+	out, err := h.runtimeCommand(strings.Join(cmds, "; "))
+	if err != nil {
+		return err
+	}
+	if err := checkRuntimeResponse(out); err != nil {
+		return err
+	}
+	h.setRunning(h.rendered)
+	return nil
+}
+
+// setRunning records that haproxy runs the given config.
+func (h *haproxyBackend) setRunning(c *haproxyConfig) {
+	h.running = c
+	h.freeLock.Lock()
+	defer h.freeLock.Unlock()
+	h.freeSlots = c.freeSlots()
+}
+
+// freeSlots returns the free server slots of the config, as
+// backend/server.
+func (c *haproxyConfig) freeSlots() util.StringSet {
+	free := util.NewStringSet()
+	for backend, slots := range c.slots {
+		for i, ep := range slots {
+			if ep == "" {
+				free.Insert(fmt.Sprintf("%v/%v", backend, haproxyServerName(backend, i)))
+			}
+		}
+	}
+	return free
+}
+
+// haproxyWeight returns the weight haproxy gives a server line rendered with
+// the given weight.
+func haproxyWeight(weight int) int {
+	if weight == 0 {
+		return 1
+	}
+	return weight
+}
+
+// checkRuntimeResponse returns an error if the output of runtime api
+// commands holds an error message.
+func checkRuntimeResponse(out string) error {
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		ok := false
+		for _, prefix := range haproxyRuntimeResponses {
+			if strings.HasPrefix(line, prefix) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("haproxy runtime api error: %v", line)
+		}
+	}
+	return nil
+}
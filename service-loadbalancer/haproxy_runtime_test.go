@@ -0,0 +1,154 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestAssignServerSlots(t *testing.T) {
+	testCases := []struct {
+		prev     []string
+		eps      []string
+		expected []string
+	}{
+		{
+			eps:      []string{"a", "b"},
+			expected: []string{"a", "b", "", ""},
+		},
+		{
+			prev:     []string{"a", "b", "", ""},
+			eps:      []string{"c", "b"},
+			expected: []string{"c", "b", "", ""},
+		},
+		{
+			prev:     []string{"a", "b", "c", "d"},
+			eps:      []string{"e", "d", "c", "b", "a"},
+			expected: []string{"a", "b", "c", "d", "e", "", "", ""},
+		},
+		{
+			prev:     []string{"a", "b", "c", "d", "e", "", "", ""},
+			eps:      []string{"e"},
+			expected: []string{"", "", "", "", "e", "", "", ""},
+		},
+	}
+	for _, tc := range testCases {
+		if slots := assignServerSlots(tc.prev, tc.eps); !reflect.DeepEqual(slots, tc.expected) {
+			t.Errorf("Expected slots %v for %v in %v, got %v", tc.expected, tc.eps, tc.prev, slots)
+		}
+	}
+}
+
+func TestUpdateEndpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "haproxy")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	h := &haproxyBackend{}
+	if err := h.updateEndpoints(); err == nil {
+		t.Errorf("Expected an error updating endpoints before the first reload")
+	}
+	services := testServices()
+	h.rendered = newHaproxyConfig(services, nil)
+	h.running = h.rendered
+
+	// Moving an endpoint only touches its slot.
+	services["httpServices"][1].Ep = []string{"1.2.3.5:8080", "1.2.3.9:8080"}
+	h.rendered = newHaproxyConfig(services, h.rendered)
+	socket, commands := fakeHaproxySocket(t, dir, "IP changed from '1.2.3.6' to '1.2.3.9', no need to change the port by 'stats socket command'\n\n\n")
+	h.statsSocket = socket
+	if err := h.updateEndpoints(); err != nil {
+		t.Fatalf("Unexpected error updating endpoints: %v", err)
+	}
+	expected := "set server web:8080/web:8080_1 addr 1.2.3.9 port 8080; set server web:8080/web:8080_1 state ready; " +
+		"set weight web:8080/web:8080_1 1\n"
+	if cmd := <-commands; cmd != expected {
+		t.Errorf("Expected %q, got %q", expected, cmd)
+	}
+	if h.running != h.rendered {
+		t.Errorf("Expected the rendered config to be running")
+	}
+
+	// Errors from haproxy mean a reload.
+	services["httpServices"][1].Ep = []string{"1.2.3.5:8080"}
+	h.rendered = newHaproxyConfig(services, h.rendered)
+	os.Remove(socket)
+	h.statsSocket, commands = fakeHaproxySocket(t, dir, "Unknown command. Please enter one of the following commands only :\n")
+	if err := h.updateEndpoints(); err == nil {
+		t.Errorf("Expected an error from an old haproxy")
+	}
+	<-commands
+
+	// Weights are updated along with the endpoints.
+	h.running = h.rendered
+	services["httpServices"][1].Ep = []string{"1.2.3.5:8080", "1.2.3.6:8080"}
+	services["httpServices"][1].Weights = map[string]int{"1.2.3.5:8080": 230, "1.2.3.6:8080": 25}
+	h.rendered = newHaproxyConfig(services, h.rendered)
+	os.Remove(h.statsSocket)
+	h.statsSocket, commands = fakeHaproxySocket(t, dir, "\n")
+	if err := h.updateEndpoints(); err != nil {
+		t.Fatalf("Unexpected error updating weights: %v", err)
+	}
+	expected = "set server web:8080/web:8080_1 addr 1.2.3.6 port 8080; set server web:8080/web:8080_1 state ready; " +
+		"set weight web:8080/web:8080_0 230; set weight web:8080/web:8080_1 25\n"
+	if cmd := <-commands; cmd != expected {
+		t.Errorf("Expected %q, got %q", expected, cmd)
+	}
+
+	// Freed slots keep their weight in haproxy until they are reused.
+	h.running = h.rendered
+	services["httpServices"][1].Ep = []string{"1.2.3.5:8080"}
+	services["httpServices"][1].Weights = nil
+	h.rendered = newHaproxyConfig(services, h.rendered)
+	os.Remove(h.statsSocket)
+	h.statsSocket, commands = fakeHaproxySocket(t, dir, "\n")
+	if err := h.updateEndpoints(); err != nil {
+		t.Fatalf("Unexpected error freeing a slot: %v", err)
+	}
+	expected = "set server web:8080/web:8080_1 state maint; set weight web:8080/web:8080_0 1\n"
+	if cmd := <-commands; cmd != expected {
+		t.Errorf("Expected %q, got %q", expected, cmd)
+	}
+	// Free slots are left out of the stats.
+	if !h.freeSlots.Has("web:8080/web:8080_1") || h.freeSlots.Has("web:8080/web:8080_0") {
+		t.Errorf("Expected web:8080_1 to be the only free slot of web:8080, got %v", h.freeSlots.List())
+	}
+	services["httpServices"][1].Ep = []string{"1.2.3.5:8080", "1.2.3.9:8080"}
+	h.rendered = newHaproxyConfig(services, h.rendered)
+	os.Remove(h.statsSocket)
+	h.statsSocket, commands = fakeHaproxySocket(t, dir, "IP changed from '127.0.0.1' to '1.2.3.9', port changed from '1' to '8080' by 'stats socket command'\n")
+	if err := h.updateEndpoints(); err != nil {
+		t.Fatalf("Unexpected error reusing a slot: %v", err)
+	}
+	expected = "set server web:8080/web:8080_1 addr 1.2.3.9 port 8080; set server web:8080/web:8080_1 state ready; " +
+		"set weight web:8080/web:8080_1 1\n"
+	if cmd := <-commands; cmd != expected {
+		t.Errorf("Expected %q, got %q", expected, cmd)
+	}
+
+	// Anything but endpoints changing needs a reload.
+	services["httpServices"][1].Algorithm = "leastconn"
+	h.rendered = newHaproxyConfig(services, h.rendered)
+	if err := h.updateEndpoints(); err == nil {
+		t.Errorf("Expected an error after changing the algorithm")
+	}
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+const (
+	// lbHealthCheckPathKey is the service annotation holding the url the
+	// loadbalancer polls to check endpoints. It takes precedence over the
+	// path of the readiness probe of the pods.
+	lbHealthCheckPathKey = "serviceloadbalancer/lb.health-check-path"
+
+	// lbHealthCheckIntervalKey is the service annotation holding the time
+	// between two checks of an endpoint, as a duration, eg: 5s.
+	lbHealthCheckIntervalKey = "serviceloadbalancer/lb.health-check-interval"
+
+	// lbHealthCheckRiseKey and lbHealthCheckFallKey are the service
+	// annotations holding the number of consecutive successful, or failed,
+	// checks after which an endpoint is considered up, or down.
+	lbHealthCheckRiseKey = "serviceloadbalancer/lb.health-check-rise"
+	lbHealthCheckFallKey = "serviceloadbalancer/lb.health-check-fall"
+
+	defaultHealthCheckInterval = 2 * time.Second
+	defaultHealthCheckRise     = 2
+	defaultHealthCheckFall     = 3
+)
+
+// healthCheck configures active http health checking of the endpoints of a
+// service, so the loadbalancer stops sending traffic to a dead pod before the
+// endpoints are updated.
+type healthCheck struct {
+	// Path is the url polled on each endpoint.
+	Path string
+
+	// Port is the port polled on each endpoint, 0 means the traffic port.
+	Port int
+
+	// Interval and Timeout are in milliseconds, a 0 Timeout means the
+	// loadbalancer default.
+	Interval int
+	Timeout  int
+
+	// Rise and Fall are the number of consecutive checks needed to consider
+	// an endpoint up or down.
+	Rise int
+	Fall int
+}
+
+// getHealthCheck returns the health check for the endpoints of the given
+// service port, or nil if there is none. The path, port and timeout come from
+// the http readiness probe of the pods backing the service, unless the service
+// has a health check path annotation. The interval and thresholds come from
+// annotations, or the defaults.
+func (lbc *loadBalancerController) getHealthCheck(s *api.Service, servicePort *api.ServicePort) *healthCheck {
+	check := lbc.getProbeHealthCheck(s, servicePort)
+	if path, ok := s.Annotations[lbHealthCheckPathKey]; ok {
+		if !strings.HasPrefix(path, "/") || strings.ContainsAny(path, " \t") {
+			lbc.reportInvalidAnnotation(s, lbHealthCheckPathKey, path,
+				fmt.Errorf("must start with / and can't contain whitespace"))
+		} else {
+			if check == nil {
+				check = &healthCheck{}
+			}
+			check.Path = path
+		}
+	}
+	if check == nil {
+		return nil
+	}
+
+	check.Interval = int(defaultHealthCheckInterval / time.Millisecond)
+	if interval, ok := s.Annotations[lbHealthCheckIntervalKey]; ok {
+		if d, err := time.ParseDuration(interval); err != nil {
+			lbc.reportInvalidAnnotation(s, lbHealthCheckIntervalKey, interval, err)
+		} else if d < time.Millisecond {
+			lbc.reportInvalidAnnotation(s, lbHealthCheckIntervalKey, interval,
+				fmt.Errorf("must be at least 1ms"))
+		} else {
+			check.Interval = int(d / time.Millisecond)
+		}
+	}
+	check.Rise = lbc.getThresholdAnnotation(s, lbHealthCheckRiseKey, defaultHealthCheckRise)
+	check.Fall = lbc.getThresholdAnnotation(s, lbHealthCheckFallKey, defaultHealthCheckFall)
+	return check
+}
+
+// getThresholdAnnotation returns the positive integer value of the given
+// annotation, or def if it's missing or invalid.
+func (lbc *loadBalancerController) getThresholdAnnotation(s *api.Service, key string, def int) int {
+	value, ok := s.Annotations[key]
+	if !ok {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 1 {
+		err = fmt.Errorf("must be at least 1")
+	}
+	if err != nil {
+		lbc.reportInvalidAnnotation(s, key, value, err)
+		return def
+	}
+	return n
+}
+
+// getProbeHealthCheck derives a health check from the http readiness probe
+// of the first pod backing the given service port that has one.
+func (lbc *loadBalancerController) getProbeHealthCheck(s *api.Service, servicePort *api.ServicePort) *healthCheck {
+	ep, err := lbc.epLister.GetServiceEndpoints(s)
+	if err != nil {
+		return nil
+	}
+	for _, ss := range ep.Subsets {
+		for _, epAddress := range ss.Addresses {
+			ref := epAddress.TargetRef
+			if ref == nil || ref.Kind != "Pod" {
+				continue
+			}
+			obj, exists, err := lbc.podStore.GetByKey(fmt.Sprintf("%v/%v", ref.Namespace, ref.Name))
+			if err != nil || !exists {
+				continue
+			}
+			if check := getPodHealthCheck(obj.(*api.Pod), servicePort); check != nil {
+				return check
+			}
+		}
+	}
+	return nil
+}
+
+// getPodHealthCheck returns a health check matching the http readiness probe
+// of the container serving the target port of the given service port.
+func getPodHealthCheck(pod *api.Pod, servicePort *api.ServicePort) *healthCheck {
+	for _, c := range pod.Spec.Containers {
+		if !servesTargetPort(&c, servicePort.TargetPort) {
+			continue
+		}
+		probe := c.ReadinessProbe
+		if probe == nil || probe.HTTPGet == nil ||
+			(probe.HTTPGet.Scheme != "" && probe.HTTPGet.Scheme != api.URISchemeHTTP) {
+			return nil
+		}
+		port := resolveContainerPort(&c, probe.HTTPGet.Port)
+		if port == 0 {
+			return nil
+		}
+		path := probe.HTTPGet.Path
+		if path == "" {
+			path = "/"
+		}
+		return &healthCheck{
+			Path:    path,
+			Port:    port,
+			Timeout: int(probe.TimeoutSeconds * 1000),
+		}
+	}
+	return nil
+}
+
+// servesTargetPort returns true if the container exposes the given port.
+// Containers don't have to declare the ports they listen on, so a numeric
+// target port matches a single container pod regardless.
+func servesTargetPort(c *api.Container, targetPort util.IntOrString) bool {
+	for _, p := range c.Ports {
+		if (targetPort.Kind == util.IntstrInt && p.ContainerPort == targetPort.IntVal) ||
+			(targetPort.Kind == util.IntstrString && p.Name == targetPort.StrVal) {
+			return true
+		}
+	}
+	return len(c.Ports) == 0 && targetPort.Kind == util.IntstrInt
+}
+
+// resolveContainerPort returns the port number of a probe port, looking up
+// named ports in the container. Returns 0 if a named port doesn't exist.
+func resolveContainerPort(c *api.Container, port util.IntOrString) int {
+	if port.Kind == util.IntstrInt {
+		return port.IntVal
+	}
+	for _, p := range c.Ports {
+		if p.Name == port.StrVal {
+			return p.ContainerPort
+		}
+	}
+	return 0
+}
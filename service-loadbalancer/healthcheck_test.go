@@ -0,0 +1,107 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+func getProbedPod(name string, probe *api.Probe) *api.Pod {
+	return &api.Pod{
+		ObjectMeta: api.ObjectMeta{Name: name, Namespace: ns},
+		Spec: api.PodSpec{
+			Containers: []api.Container{
+				{Name: "sidecar", Ports: []api.ContainerPort{{Name: "metrics", ContainerPort: 9090}}},
+				{Name: "app", Ports: []api.ContainerPort{{Name: "http", ContainerPort: 8080}, {Name: "admin", ContainerPort: 8081}},
+					ReadinessProbe: probe},
+			},
+		},
+	}
+}
+
+func TestGetHealthCheck(t *testing.T) {
+	httpProbe := &api.Probe{
+		Handler: api.Handler{HTTPGet: &api.HTTPGetAction{
+			Path: "/ready", Port: util.NewIntOrStringFromString("admin")}},
+		TimeoutSeconds: 3,
+	}
+	execProbe := &api.Probe{Handler: api.Handler{Exec: &api.ExecAction{Command: []string{"true"}}}}
+
+	testCases := []struct {
+		probe       *api.Probe
+		annotations map[string]string
+		expected    *healthCheck
+		events      int
+	}{
+		{
+			probe:    httpProbe,
+			expected: &healthCheck{Path: "/ready", Port: 8081, Interval: 2000, Timeout: 3000, Rise: 2, Fall: 3},
+		},
+		{
+			probe: httpProbe,
+			annotations: map[string]string{
+				lbHealthCheckPathKey:     "/healthz",
+				lbHealthCheckIntervalKey: "500ms",
+				lbHealthCheckRiseKey:     "1",
+				lbHealthCheckFallKey:     "5",
+			},
+			expected: &healthCheck{Path: "/healthz", Port: 8081, Interval: 500, Timeout: 3000, Rise: 1, Fall: 5},
+		},
+		{
+			probe: execProbe,
+		},
+		{
+			probe:       execProbe,
+			annotations: map[string]string{lbHealthCheckPathKey: "/healthz"},
+			expected:    &healthCheck{Path: "/healthz", Interval: 2000, Rise: 2, Fall: 3},
+		},
+		{
+			probe: httpProbe,
+			annotations: map[string]string{
+				lbHealthCheckPathKey:     "healthz",
+				lbHealthCheckIntervalKey: "often",
+				lbHealthCheckFallKey:     "0",
+			},
+			expected: &healthCheck{Path: "/ready", Port: 8081, Interval: 2000, Timeout: 3000, Rise: 2, Fall: 3},
+			events:   3,
+		},
+	}
+
+	for _, tc := range testCases {
+		pod := getProbedPod("pod-1", tc.probe)
+		svc := getService([]api.ServicePort{
+			{Name: "http", Port: 80, TargetPort: util.NewIntOrStringFromString("http")}})
+		svc.Annotations = tc.annotations
+		endpoints := []*api.Endpoints{getEndpoints(svc,
+			[]api.EndpointAddress{{IP: "1.2.3.4", TargetRef: &api.ObjectReference{Kind: "Pod", Namespace: ns, Name: pod.Name}}},
+			[]api.EndpointPort{{Name: "http", Port: 8080}})}
+		flb := newFakeLoadBalancerController(endpoints, []*api.Service{svc})
+		flb.podStore.Add(pod)
+
+		check := flb.getHealthCheck(svc, &svc.Spec.Ports[0])
+		if !reflect.DeepEqual(check, tc.expected) {
+			t.Errorf("Expected health check %+v for %v, got %+v", tc.expected, tc.annotations, check)
+		}
+		if events := flb.recorder.(*fakeEventRecorder).events; len(events) != tc.events {
+			t.Errorf("Expected %v events for %v, got %v", tc.events, tc.annotations, events)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+	"k8s.io/kubernetes/pkg/client/testclient"
+	"k8s.io/kubernetes/pkg/runtime"
+	"k8s.io/kubernetes/pkg/util"
+	"k8s.io/kubernetes/pkg/util/wait"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// fakeAPI is an in memory apiserver the controller can list and watch
+// services, endpoints, secrets and pods from.
+type fakeAPI struct {
+	lock         sync.Mutex
+	objects      map[string]map[string]runtime.Object
+	broadcasters map[string]*watch.Broadcaster
+	watches      map[string]int
+	// resourceVersion is bumped on every change, the reflectors of the
+	// controller resume watches from the last version they saw.
+	resourceVersion int
+}
+
+func newFakeAPI() *fakeAPI {
+	f := &fakeAPI{
+		objects:      map[string]map[string]runtime.Object{},
+		broadcasters: map[string]*watch.Broadcaster{},
+		watches:      map[string]int{},
+	}
+	for _, resource := range []string{"services", "endpoints", "secrets", "pods"} {
+		f.objects[resource] = map[string]runtime.Object{}
+		f.broadcasters[resource] = watch.NewBroadcaster(100, watch.WaitIfChannelFull)
+	}
+	return f
+}
+
+// listWatch is the listWatchFunc of the fake apiserver.
+func (f *fakeAPI) listWatch(resource string) cache.ListerWatcher {
+	return &cache.ListWatch{
+		ListFunc: func() (runtime.Object, error) {
+			return f.list(resource), nil
+		},
+		WatchFunc: func(resourceVersion string) (watch.Interface, error) {
+			f.lock.Lock()
+			defer f.lock.Unlock()
+			f.watches[resource]++
+			return f.broadcasters[resource].Watch(), nil
+		},
+	}
+}
+
+// list returns the objects of a resource as a list of the matching type.
+func (f *fakeAPI) list(resource string) runtime.Object {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	meta := api.ListMeta{ResourceVersion: strconv.Itoa(f.resourceVersion)}
+	switch resource {
+	case "services":
+		list := &api.ServiceList{ListMeta: meta}
+		for _, obj := range f.objects[resource] {
+			list.Items = append(list.Items, *obj.(*api.Service))
+		}
+		return list
+	case "endpoints":
+		list := &api.EndpointsList{ListMeta: meta}
+		for _, obj := range f.objects[resource] {
+			list.Items = append(list.Items, *obj.(*api.Endpoints))
+		}
+		return list
+	case "secrets":
+		list := &api.SecretList{ListMeta: meta}
+		for _, obj := range f.objects[resource] {
+			list.Items = append(list.Items, *obj.(*api.Secret))
+		}
+		return list
+	default:
+		list := &api.PodList{ListMeta: meta}
+		for _, obj := range f.objects[resource] {
+			list.Items = append(list.Items, *obj.(*api.Pod))
+		}
+		return list
+	}
+}
+
+// watching returns true once every resource is watched.
+func (f *fakeAPI) watching() bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for resource := range f.objects {
+		if f.watches[resource] == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// set creates or updates an object, and notifies the watchers.
+func (f *fakeAPI) set(resource string, obj runtime.Object) {
+	key, _ := cache.MetaNamespaceKeyFunc(obj)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.setResourceVersion(obj)
+	action := watch.Added
+	if _, ok := f.objects[resource][key]; ok {
+		action = watch.Modified
+	}
+	f.objects[resource][key] = obj
+	f.broadcasters[resource].Action(action, obj)
+}
+
+// delete deletes an object, and notifies the watchers.
+func (f *fakeAPI) delete(resource string, obj runtime.Object) {
+	key, _ := cache.MetaNamespaceKeyFunc(obj)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.setResourceVersion(obj)
+	delete(f.objects[resource], key)
+	f.broadcasters[resource].Action(watch.Deleted, obj)
+}
+
+// setResourceVersion stamps the object with the next resource version.
+// Callers must hold the lock.
+func (f *fakeAPI) setResourceVersion(obj runtime.Object) {
+	f.resourceVersion++
+	meta, _ := api.ObjectMetaFor(obj)
+	meta.ResourceVersion = strconv.Itoa(f.resourceVersion)
+}
+
+// newTestService returns a service called name, and its endpoints.
+func newTestService(name string, ips ...string) (*api.Service, *api.Endpoints) {
+	svc := getService([]api.ServicePort{{Port: 80, TargetPort: util.NewIntOrStringFromInt(8080)}})
+	svc.Name = name
+	addresses := []api.EndpointAddress{}
+	for _, ip := range ips {
+		addresses = append(addresses, api.EndpointAddress{IP: ip})
+	}
+	return svc, getEndpoints(svc, addresses, []api.EndpointPort{{Port: 8080}})
+}
+
+func TestControllerSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "servicelb")
+	if err != nil {
+		t.Fatalf("Unexpected error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "haproxy.cfg")
+	reloadsPath := filepath.Join(dir, "reloads")
+	cfg := &loadBalancerConfig{
+		Name:      "haproxy",
+		Config:    configPath,
+		ReloadCmd: fmt.Sprintf("echo reloaded >> %v", reloadsPath),
+	}
+	if cfg.backend, err = newLoadBalancerBackend(cfg); err != nil {
+		t.Fatalf("Unexpected error creating backend: %v", err)
+	}
+	h := cfg.backend.(*haproxyBackend)
+	h.statsSocket = filepath.Join(dir, "haproxy.sock")
+
+	fake := newFakeAPI()
+	web, webEndpoints := newTestService("web", "1.2.3.4")
+	fake.set("services", web)
+	fake.set("endpoints", webEndpoints)
+	lbc := newLoadBalancerController(cfg, testclient.NewSimpleFake(), fake.listWatch, ns)
+
+	// Nothing is synced until every watch is populated.
+	if err := lbc.sync(false); err != deferredSync {
+		t.Fatalf("Expected a deferred sync before the watches are populated, got %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go lbc.epController.Run(stop)
+	go lbc.svcController.Run(stop)
+	go lbc.secretController.Run(stop)
+	go lbc.podController.Run(stop)
+	go lbc.worker()
+	defer lbc.queue.ShutDown()
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return fake.watching(), nil
+	}); err != nil {
+		t.Fatalf("Controllers never watched the fake apiserver")
+	}
+
+	// waitFor waits for the config to match, and the proxy to have been
+	// reloaded the given number of times.
+	waitFor := func(step string, reloads int, match func(config string) bool) {
+		var config string
+		var got int
+		err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+			data, _ := ioutil.ReadFile(configPath)
+			config = string(data)
+			data, _ = ioutil.ReadFile(reloadsPath)
+			got = strings.Count(string(data), "reloaded")
+			return match(config) && got == reloads && lbc.queue.Len() == 0, nil
+		})
+		if err != nil {
+			t.Fatalf("%v: expected %d reloads, got %d, with config:\n%v", step, reloads, got, config)
+		}
+	}
+	has := func(lines ...string) func(string) bool {
+		return func(config string) bool {
+			for _, line := range lines {
+				if !strings.Contains(config, line) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	waitFor("initial sync", 1, has("backend web", "server web_0 1.2.3.4:8080"))
+
+	api, apiEndpoints := newTestService("api", "1.2.3.6")
+	fake.set("services", api)
+	fake.set("endpoints", apiEndpoints)
+	waitFor("adding a service", 2, has("backend web", "backend api", "server api_0 1.2.3.6:8080"))
+
+	// Endpoint changes go through the runtime api, without a reload.
+	socket, commands := fakeHaproxySocket(t, dir, "IP changed from '127.0.0.1' to '1.2.3.5' by 'stats socket command'\n")
+	_, webEndpoints = newTestService("web", "1.2.3.4", "1.2.3.5")
+	fake.set("endpoints", webEndpoints)
+	waitFor("adding an endpoint", 2, has("server web_1 1.2.3.5:8080"))
+	expected := "set server web/web_1 addr 1.2.3.5 port 8080; set server web/web_1 state ready; set weight web/web_1 1\n"
+	if cmd := <-commands; cmd != expected {
+		t.Errorf("Expected %q, got %q", expected, cmd)
+	}
+	os.Remove(socket)
+
+	// Without the runtime api, endpoint changes fall back to a reload.
+	_, webEndpoints = newTestService("web", "1.2.3.5")
+	fake.set("endpoints", webEndpoints)
+	waitFor("removing an endpoint", 3, func(config string) bool {
+		return strings.Contains(config, "server web_1 1.2.3.5:8080") && !strings.Contains(config, "1.2.3.4:8080")
+	})
+
+	// Services without endpoints are dropped.
+	fake.delete("endpoints", apiEndpoints)
+	waitFor("deleting endpoints", 4, func(config string) bool {
+		return !strings.Contains(config, "backend api")
+	})
+	fake.delete("services", api)
+
+	// Settings changes are rendered and reloaded.
+	updated := *web
+	updated.Annotations = map[string]string{lbAlgorithmKey: "leastconn"}
+	fake.set("services", &updated)
+	waitFor("updating a service", 5, has("balance leastconn"))
+}
+
+func TestLeaderLockDoesNotSync(t *testing.T) {
+	defer func(vip string) { *haVIP = vip }(*haVIP)
+	*haVIP = "10.0.0.1"
+	fake := newFakeAPI()
+	lbc := newLoadBalancerController(&loadBalancerConfig{}, testclient.NewSimpleFake(), fake.listWatch, ns)
+	stop := make(chan struct{})
+	defer close(stop)
+	go lbc.epController.Run(stop)
+	go lbc.svcController.Run(stop)
+	go lbc.secretController.Run(stop)
+	go lbc.podController.Run(stop)
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return fake.watching(), nil
+	}); err != nil {
+		t.Fatalf("Controllers never watched the fake apiserver")
+	}
+
+	// Lease renewals rewrite the lock, they don't change any service.
+	lock := &api.Endpoints{ObjectMeta: api.ObjectMeta{Name: *haLock, Namespace: ns}}
+	for i := 0; i < 3; i++ {
+		renewed := *lock
+		renewed.Annotations = map[string]string{leaderKey: strconv.Itoa(i)}
+		fake.set("endpoints", &renewed)
+	}
+	_, webEndpoints := newTestService("web", "1.2.3.4")
+	fake.set("endpoints", webEndpoints)
+	if err := wait.Poll(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		_, exists, _ := lbc.epLister.Store.Get(webEndpoints)
+		return exists, nil
+	}); err != nil {
+		t.Fatalf("The web endpoints were never seen")
+	}
+	if n := lbc.queue.Len(); n != 1 {
+		t.Errorf("Expected only the web endpoints to be queued, got %d keys", n)
+	}
+}
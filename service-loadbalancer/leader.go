@@ -0,0 +1,282 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/client"
+)
+
+// leaderKey is the annotation of the lock endpoints holding the leaderRecord.
+const leaderKey = "serviceloadbalancer/leader"
+
+// leaderRecord is the lease held by the leader of a group of loadbalancers.
+type leaderRecord struct {
+	HolderIdentity       string    `json:"holderIdentity"`
+	LeaseDurationSeconds int       `json:"leaseDurationSeconds"`
+	AcquireTime          time.Time `json:"acquireTime"`
+	RenewTime            time.Time `json:"renewTime"`
+}
+
+// leaderStatus is what the healthz server reports about the election.
+type leaderStatus struct {
+	Identity string `json:"identity"`
+	Leader   string `json:"leader"`
+	IsLeader bool   `json:"isLeader"`
+	// LeaderSince is when the current leader acquired the lease.
+	LeaderSince time.Time `json:"leaderSince"`
+	// LastFailoverSeconds is the time between the last renewal of the
+	// previous leader, and this replica taking over from it.
+	LastFailoverSeconds float64 `json:"lastFailoverSeconds"`
+}
+
+// leaderElector elects a leader among the loadbalancer replicas sharing a
+// lock. The lock is an endpoints object without subsets, so it needs no new
+// api types: the leader keeps renewing a lease in an annotation, and any
+// replica can take over once the lease expires. Updates rely on the
+// resourceVersion of the endpoints, so only one replica can win a race.
+type leaderElector struct {
+	client        client.EndpointsNamespacer
+	namespace     string
+	name          string
+	identity      string
+	leaseDuration time.Duration
+	retryPeriod   time.Duration
+
+	// onStartedLeading and onStoppedLeading are called when this replica
+	// gains and loses the lease.
+	onStartedLeading func()
+	onStoppedLeading func()
+
+	lock     sync.Mutex
+	status   leaderStatus
+	observed leaderRecord
+	// observedTime is when observed was last seen to change, measured on
+	// our clock to be immune to clock skew between replicas.
+	observedTime time.Time
+}
+
+func newLeaderElector(kubeClient client.EndpointsNamespacer, namespace, name, identity string, leaseDuration time.Duration) *leaderElector {
+	return &leaderElector{
+		client:        kubeClient,
+		namespace:     namespace,
+		name:          name,
+		identity:      identity,
+		leaseDuration: leaseDuration,
+		retryPeriod:   leaseDuration / 3,
+		status:        leaderStatus{Identity: identity},
+	}
+}
+
+// run tries to acquire or renew the lease every retryPeriod, forever.
+func (le *leaderElector) run() {
+	for {
+		le.tryAcquireOrRenew(time.Now())
+		time.Sleep(le.retryPeriod)
+	}
+}
+
+// getStatus returns the current state of the election.
+func (le *leaderElector) getStatus() leaderStatus {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	return le.status
+}
+
+// tryAcquireOrRenew takes the lease if it's free or expired, or renews it if
+// we hold it. It returns true if we hold the lease afterwards.
+func (le *leaderElector) tryAcquireOrRenew(now time.Time) bool {
+	ep, err := le.client.Endpoints(le.namespace).Get(le.name)
+	if err != nil && !errors.IsNotFound(err) {
+		glog.Errorf("Unable to read leader lock %v/%v: %v", le.namespace, le.name, err)
+		le.setLeading(le.stillLeading(now), le.observed)
+		return le.getStatus().IsLeader
+	}
+
+	record := leaderRecord{
+		HolderIdentity:       le.identity,
+		LeaseDurationSeconds: int(le.leaseDuration / time.Second),
+		AcquireTime:          now,
+		RenewTime:            now,
+	}
+	if err != nil {
+		ep = &api.Endpoints{ObjectMeta: api.ObjectMeta{Name: le.name, Namespace: le.namespace}}
+	} else if current, ok := le.readRecord(ep, now); ok {
+		if current.HolderIdentity != le.identity && le.observedTime.Add(le.leaseDuration).After(now) {
+			// Someone else holds an unexpired lease.
+			le.setLeading(false, current)
+			return false
+		}
+		if current.HolderIdentity == le.identity {
+			record.AcquireTime = current.AcquireTime
+		}
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		glog.Errorf("Unable to encode leader record: %v", err)
+		return false
+	}
+	if ep.Annotations == nil {
+		ep.Annotations = map[string]string{}
+	}
+	ep.Annotations[leaderKey] = string(data)
+	if ep.ResourceVersion == "" {
+		_, err = le.client.Endpoints(le.namespace).Create(ep)
+	} else {
+		_, err = le.client.Endpoints(le.namespace).Update(ep)
+	}
+	if err != nil {
+		// Most likely another replica won the race, we'll see it next time.
+		glog.V(2).Infof("Unable to acquire leader lock %v/%v: %v", le.namespace, le.name, err)
+		le.setLeading(le.stillLeading(now), le.observed)
+		return le.getStatus().IsLeader
+	}
+	if previous := le.observed.HolderIdentity; previous != "" && previous != le.identity {
+		// The previous leader renewed its lease at most a retry period
+		// before we saw its last renewal.
+		le.lock.Lock()
+		le.status.LastFailoverSeconds = now.Sub(le.observedTime).Seconds()
+		le.lock.Unlock()
+		glog.Infof("Took over %v/%v from %v", le.namespace, le.name, previous)
+	}
+	le.observed, le.observedTime = record, now
+	le.setLeading(true, record)
+	return true
+}
+
+// readRecord returns the leader record of the lock, and tracks when it last
+// changed.
+func (le *leaderElector) readRecord(ep *api.Endpoints, now time.Time) (leaderRecord, bool) {
+	data, ok := ep.Annotations[leaderKey]
+	if !ok {
+		return leaderRecord{}, false
+	}
+	var record leaderRecord
+	if err := json.Unmarshal([]byte(data), &record); err != nil {
+		glog.Errorf("Ignoring invalid leader record %q: %v", data, err)
+		return leaderRecord{}, false
+	}
+	if record != le.observed {
+		le.observed, le.observedTime = record, now
+	}
+	return record, true
+}
+
+// stillLeading returns true if we hold a lease that hasn't expired yet, used
+// when the lock can't be renewed.
+func (le *leaderElector) stillLeading(now time.Time) bool {
+	return le.observed.HolderIdentity == le.identity && le.observedTime.Add(le.leaseDuration).After(now)
+}
+
+// setLeading records the state of the election, and calls the callbacks on
+// transitions.
+func (le *leaderElector) setLeading(leading bool, record leaderRecord) {
+	le.lock.Lock()
+	wasLeading := le.status.IsLeader
+	le.status.IsLeader = leading
+	le.status.Leader = record.HolderIdentity
+	le.status.LeaderSince = record.AcquireTime
+	status := le.status
+	le.lock.Unlock()
+
+	if leading != wasLeading {
+		glog.Infof("Leader of %v/%v is now %v", le.namespace, le.name, status.Leader)
+		if leading && le.onStartedLeading != nil {
+			le.onStartedLeading()
+		}
+		if !leading && le.onStoppedLeading != nil {
+			le.onStoppedLeading()
+		}
+	}
+	recordLeaderStatus(status)
+}
+
+// haLockNamespace returns the namespace of the --ha-lock endpoints of a
+// controller watching the given namespace.
+func haLockNamespace(namespace string) string {
+	if namespace == api.NamespaceAll {
+		return api.NamespaceDefault
+	}
+	return namespace
+}
+
+// newHAElector returns a leader elector for --ha-vip: the leader claims the
+// vip with the announcer, and the election is reported on the healthz server
+// under /leader.
+func newHAElector(kubeClient client.EndpointsNamespacer, namespace, vip string, announcer vipAnnouncer) *leaderElector {
+	identity, err := os.Hostname()
+	if err != nil {
+		glog.Fatalf("Unable to get the hostname for leader election: %v", err)
+	}
+	le := newLeaderElector(kubeClient, namespace, *haLock, identity, *haLeaseDuration)
+	le.onStartedLeading = func() {
+		if err := announcer.up(vip); err != nil {
+			glog.Errorf("Unable to claim %v: %v", vip, err)
+		}
+	}
+	le.onStoppedLeading = func() {
+		if err := announcer.down(vip); err != nil {
+			glog.Errorf("Unable to release %v: %v", vip, err)
+		}
+	}
+	http.HandleFunc("/leader", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(le.getStatus())
+	})
+	return le
+}
+
+// vipAnnouncer claims and releases a virtual ip on this node.
+type vipAnnouncer interface {
+	up(vip string) error
+	down(vip string) error
+}
+
+// scriptAnnouncer runs a script with "up <vip>" or "down <vip>". The shipped
+// vip_announce script adds the ip to an interface and sends gratuitous arps,
+// like a VRRP master.
+type scriptAnnouncer struct {
+	cmd string
+}
+
+func (s *scriptAnnouncer) up(vip string) error {
+	return s.run("up", vip)
+}
+
+func (s *scriptAnnouncer) down(vip string) error {
+	return s.run("down", vip)
+}
+
+func (s *scriptAnnouncer) run(action, vip string) error {
+	output, err := exec.Command("sh", "-c", fmt.Sprintf("%v %v %v", s.cmd, action, vip)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("error running %v %v %v: %v\n%v", s.cmd, action, vip, err, string(output))
+	}
+	glog.Infof("%v %v %v -- %v", s.cmd, action, vip, string(output))
+	return nil
+}
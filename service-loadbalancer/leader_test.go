@@ -0,0 +1,132 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/api/errors"
+	"k8s.io/kubernetes/pkg/client"
+	"k8s.io/kubernetes/pkg/fields"
+	"k8s.io/kubernetes/pkg/labels"
+	"k8s.io/kubernetes/pkg/watch"
+)
+
+// fakeEndpoints is an in memory endpoints client that checks resource
+// versions on update, like the apiserver.
+type fakeEndpoints struct {
+	endpoints map[string]*api.Endpoints
+	version   int
+}
+
+func (f *fakeEndpoints) Endpoints(namespace string) client.EndpointsInterface { return f }
+
+func (f *fakeEndpoints) Get(name string) (*api.Endpoints, error) {
+	ep, ok := f.endpoints[name]
+	if !ok {
+		return nil, errors.NewNotFound("endpoints", name)
+	}
+	copy := *ep
+	copy.Annotations = map[string]string{}
+	for k, v := range ep.Annotations {
+		copy.Annotations[k] = v
+	}
+	return &copy, nil
+}
+
+func (f *fakeEndpoints) Create(ep *api.Endpoints) (*api.Endpoints, error) {
+	if _, ok := f.endpoints[ep.Name]; ok {
+		return nil, errors.NewAlreadyExists("endpoints", ep.Name)
+	}
+	return f.store(ep), nil
+}
+
+func (f *fakeEndpoints) Update(ep *api.Endpoints) (*api.Endpoints, error) {
+	if current, ok := f.endpoints[ep.Name]; !ok || current.ResourceVersion != ep.ResourceVersion {
+		return nil, errors.NewConflict("endpoints", ep.Name, fmt.Errorf("resource version changed"))
+	}
+	return f.store(ep), nil
+}
+
+func (f *fakeEndpoints) store(ep *api.Endpoints) *api.Endpoints {
+	f.version++
+	ep.ResourceVersion = strconv.Itoa(f.version)
+	f.endpoints[ep.Name] = ep
+	return ep
+}
+
+func (f *fakeEndpoints) List(selector labels.Selector) (*api.EndpointsList, error) { return nil, nil }
+func (f *fakeEndpoints) Delete(name string) error                                  { return nil }
+func (f *fakeEndpoints) Watch(label labels.Selector, field fields.Selector, resourceVersion string) (watch.Interface, error) {
+	return nil, nil
+}
+
+func TestLeaderElection(t *testing.T) {
+	lock := &fakeEndpoints{endpoints: map[string]*api.Endpoints{}}
+	transitions := []string{}
+	newElector := func(identity string) *leaderElector {
+		le := newLeaderElector(lock, "default", "lock", identity, 15*time.Second)
+		le.onStartedLeading = func() { transitions = append(transitions, identity+" up") }
+		le.onStoppedLeading = func() { transitions = append(transitions, identity+" down") }
+		return le
+	}
+	a, b := newElector("a"), newElector("b")
+	start := time.Now()
+
+	if !a.tryAcquireOrRenew(start) {
+		t.Fatalf("Expected a to acquire a free lock")
+	}
+	if b.tryAcquireOrRenew(start.Add(time.Second)) {
+		t.Errorf("Expected b not to acquire a held lock")
+	}
+	if status := b.getStatus(); status.Leader != "a" || status.IsLeader {
+		t.Errorf("Expected b to see a as the leader, got %+v", status)
+	}
+
+	// a keeps renewing, b can't take over even after a lease duration.
+	for i := 1; i <= 4; i++ {
+		now := start.Add(time.Duration(i) * 5 * time.Second)
+		if !a.tryAcquireOrRenew(now) || b.tryAcquireOrRenew(now) {
+			t.Fatalf("Expected a to keep the lock at %v", now.Sub(start))
+		}
+	}
+
+	// a stops renewing, b takes over once the lease expired.
+	lastRenewal := start.Add(20 * time.Second)
+	if b.tryAcquireOrRenew(lastRenewal.Add(10 * time.Second)) {
+		t.Errorf("Expected b not to acquire the lock before the lease expired")
+	}
+	if !b.tryAcquireOrRenew(lastRenewal.Add(16 * time.Second)) {
+		t.Fatalf("Expected b to acquire an expired lock")
+	}
+	if status := b.getStatus(); status.LastFailoverSeconds != 16 {
+		t.Errorf("Expected a 16s failover, got %+v", status)
+	}
+
+	// a comes back and steps down.
+	if a.tryAcquireOrRenew(lastRenewal.Add(17 * time.Second)) {
+		t.Errorf("Expected a to lose the lock to b")
+	}
+	expected := "[a up b up a down]"
+	if fmt.Sprintf("%v", transitions) != expected {
+		t.Errorf("Expected transitions %v, got %v", expected, transitions)
+	}
+}
@@ -0,0 +1,240 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/kubernetes/pkg/util/workqueue"
+)
+
+const metricsNamespace = "servicelb"
+
+var (
+	// configValidationErrors counts rendered configs rejected by the validateCmd.
+	configValidationErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_validation_errors_total",
+		Help:      "Number of rendered configs rejected by the loadbalancer's validate command.",
+	})
+
+	// syncs counts syncs by result: success, error, invalid (the config
+	// was rejected) or deferred (the watches aren't populated yet).
+	syncs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "syncs_total",
+		Help:      "Number of syncs of the services with the loadbalancer, by result.",
+	}, []string{"result"})
+
+	syncLatency = prometheus.NewSummary(prometheus.SummaryOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Time taken to sync the services with the loadbalancer, including the reload.",
+	})
+
+	// reloads counts reloads of the loadbalancer by result: success or failure.
+	reloads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "reloads_total",
+		Help:      "Number of reloads of the loadbalancer, by result.",
+	}, []string{"result"})
+
+	// endpointUpdates counts endpoint changes applied to the running proxy
+	// without a reload, by result: success or fallback (to a reload).
+	endpointUpdates = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "endpoint_updates_total",
+		Help:      "Number of endpoint changes applied without a reload, by result.",
+	}, []string{"result"})
+
+	serviceCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "services",
+		Help:      "Number of services in the loadbalancer config, by type.",
+	}, []string{"type"})
+
+	endpointCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "endpoints",
+		Help:      "Number of endpoints in the loadbalancer config, by service type.",
+	}, []string{"type"})
+
+	isLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader",
+		Help:      "1 if this replica is the leader holding the virtual ip, 0 otherwise.",
+	})
+
+	failoverSeconds = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "leader_failover_seconds",
+		Help:      "Time between the last renewal of the previous leader and this replica taking over.",
+	})
+)
+
+// serviceTypes maps the keys of the services passed to the templates to the
+// type label of the service metrics.
+var serviceTypes = map[string]string{
+	"httpServices":  "http",
+	"httpsServices": "https",
+	"tcpServices":   "tcp",
+	"udpServices":   "udp",
+}
+
+func init() {
+	prometheus.MustRegister(configValidationErrors)
+	prometheus.MustRegister(syncs)
+	prometheus.MustRegister(syncLatency)
+	prometheus.MustRegister(reloads)
+	prometheus.MustRegister(endpointUpdates)
+	prometheus.MustRegister(serviceCount)
+	prometheus.MustRegister(endpointCount)
+	prometheus.MustRegister(isLeader)
+	prometheus.MustRegister(failoverSeconds)
+}
+
+// registerControllerMetrics registers the metrics read from a running
+// controller: the depth of its queue and the stats of its proxy.
+func registerControllerMetrics(lbc *loadBalancerController) {
+	prometheus.MustRegister(newQueueDepthGauge(lbc.queue))
+	prometheus.MustRegister(newProxyStatsCollector(lbc.cfg.backend))
+}
+
+func newQueueDepthGauge(queue *workqueue.Type) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Number of service changes waiting for a sync.",
+	}, func() float64 { return float64(queue.Len()) })
+}
+
+// recordSync records the result and duration of a sync that started at start.
+func recordSync(start time.Time, err error) {
+	switch err.(type) {
+	case nil:
+		syncs.WithLabelValues("success").Inc()
+	case *configValidationError:
+		syncs.WithLabelValues("invalid").Inc()
+	default:
+		if err == deferredSync {
+			// Deferred syncs didn't do anything, don't skew the latency.
+			syncs.WithLabelValues("deferred").Inc()
+			return
+		}
+		syncs.WithLabelValues("error").Inc()
+	}
+	syncLatency.Observe(time.Since(start).Seconds())
+}
+
+// recordReload records the result of a reload of the loadbalancer.
+func recordReload(err error) {
+	if err != nil {
+		reloads.WithLabelValues("failure").Inc()
+		return
+	}
+	reloads.WithLabelValues("success").Inc()
+}
+
+// recordEndpointUpdate records the result of an endpoint update without a
+// reload.
+func recordEndpointUpdate(err error) {
+	if err != nil {
+		endpointUpdates.WithLabelValues("fallback").Inc()
+		return
+	}
+	endpointUpdates.WithLabelValues("success").Inc()
+}
+
+// recordLeaderStatus records the state of the leader election.
+func recordLeaderStatus(status leaderStatus) {
+	if status.IsLeader {
+		isLeader.Set(1)
+	} else {
+		isLeader.Set(0)
+	}
+	failoverSeconds.Set(status.LastFailoverSeconds)
+}
+
+// recordServices records the number of services and endpoints of each type
+// in the given template input.
+func recordServices(svcs map[string][]service) {
+	for key, svcType := range serviceTypes {
+		eps := 0
+		for _, svc := range svcs[key] {
+			eps += len(svc.Ep)
+		}
+		serviceCount.WithLabelValues(svcType).Set(float64(len(svcs[key])))
+		endpointCount.WithLabelValues(svcType).Set(float64(eps))
+	}
+}
+
+// proxyStatsCollector exports the stats of a proxy, collected from the proxy
+// on each scrape so the counters are never stale.
+type proxyStatsCollector struct {
+	backend  loadBalancerBackend
+	up       *prometheus.Desc
+	requests *prometheus.Desc
+	errors   *prometheus.Desc
+	servers  *prometheus.Desc
+}
+
+func newProxyStatsCollector(backend loadBalancerBackend) *proxyStatsCollector {
+	return &proxyStatsCollector{
+		backend: backend,
+		up: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "proxy", "up"),
+			"Whether the last scrape of the proxy stats succeeded.",
+			nil, nil),
+		requests: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "proxy", "requests_total"),
+			"Number of requests, or connections for tcp services, handled by a proxy backend.",
+			[]string{"backend"}, nil),
+		errors: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "proxy", "errors_total"),
+			"Number of failed connections to, or responses from, the servers of a proxy backend.",
+			[]string{"backend"}, nil),
+		servers: prometheus.NewDesc(
+			prometheus.BuildFQName(metricsNamespace, "proxy", "servers"),
+			"Number of servers of a proxy backend, by state.",
+			[]string{"backend", "state"}, nil),
+	}
+}
+
+func (c *proxyStatsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.up
+	ch <- c.requests
+	ch <- c.errors
+	ch <- c.servers
+}
+
+func (c *proxyStatsCollector) Collect(ch chan<- prometheus.Metric) {
+	stats, err := c.backend.stats()
+	if err != nil {
+		glog.V(2).Infof("Unable to scrape proxy stats: %v", err)
+		ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.up, prometheus.GaugeValue, 1)
+	for _, s := range stats {
+		ch <- prometheus.MustNewConstMetric(c.requests, prometheus.CounterValue, float64(s.Requests), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.errors, prometheus.CounterValue, float64(s.Errors), s.Name)
+		ch <- prometheus.MustNewConstMetric(c.servers, prometheus.GaugeValue, float64(s.ServersUp), s.Name, "up")
+		ch <- prometheus.MustNewConstMetric(c.servers, prometheus.GaugeValue, float64(s.ServersDown), s.Name, "down")
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeBackend is a loadBalancerBackend returning canned stats.
+type fakeBackend struct {
+	proxyStats []proxyStats
+	err        error
+}
+
+func (f *fakeBackend) render(w io.Writer, services map[string][]service) error { return nil }
+func (f *fakeBackend) validate(path string) error                              { return nil }
+func (f *fakeBackend) reload() (string, error)                                 { return "", nil }
+func (f *fakeBackend) healthz() error                                          { return f.err }
+func (f *fakeBackend) stats() ([]proxyStats, error)                            { return f.proxyStats, f.err }
+
+// collect returns the metrics of the given collector, keyed by their
+// description and labels.
+func collect(t *testing.T, c prometheus.Collector) map[string]float64 {
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+	metrics := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatalf("Unexpected error writing metric: %v", err)
+		}
+		key := m.Desc().String()
+		for _, l := range pb.Label {
+			key += fmt.Sprintf(" %v=%v", l.GetName(), l.GetValue())
+		}
+		switch {
+		case pb.Gauge != nil:
+			metrics[key] = pb.Gauge.GetValue()
+		case pb.Counter != nil:
+			metrics[key] = pb.Counter.GetValue()
+		}
+	}
+	return metrics
+}
+
+func TestProxyStatsCollector(t *testing.T) {
+	backend := &fakeBackend{proxyStats: []proxyStats{
+		{Name: "web", Requests: 10, Errors: 3, ServersUp: 1, ServersDown: 2},
+	}}
+	c := newProxyStatsCollector(backend)
+	metrics := collect(t, c)
+	for key, expected := range map[string]float64{
+		c.up.String():                                  1,
+		c.requests.String() + " backend=web":           10,
+		c.errors.String() + " backend=web":             3,
+		c.servers.String() + " backend=web state=up":   1,
+		c.servers.String() + " backend=web state=down": 2,
+	} {
+		if value, ok := metrics[key]; !ok || value != expected {
+			t.Errorf("Expected %v to be %v, got %v", key, expected, metrics)
+		}
+	}
+
+	backend.err = fmt.Errorf("haproxy is down")
+	metrics = collect(t, c)
+	if len(metrics) != 1 || metrics[c.up.String()] != 0 {
+		t.Errorf("Expected only a 0 up metric, got %v", metrics)
+	}
+}
+
+func TestRecordServices(t *testing.T) {
+	recordServices(testServices())
+	metrics := collect(t, endpointCount)
+	desc := <-describe(endpointCount)
+	for svcType, expected := range map[string]float64{"http": 3, "https": 1, "tcp": 1} {
+		key := fmt.Sprintf("%v type=%v", desc.String(), svcType)
+		if metrics[key] != expected {
+			t.Errorf("Expected %v %v endpoints, got %v", expected, svcType, metrics)
+		}
+	}
+}
+
+// describe returns the descriptions of the given collector.
+func describe(c prometheus.Collector) chan *prometheus.Desc {
+	ch := make(chan *prometheus.Desc, 1)
+	c.Describe(ch)
+	return ch
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/golang/glog"
+)
+
+// nginxBackend configures nginx. Unlike haproxy, nginx routes by host with a
+// server block per hostname, so http services are grouped into servers
+// before they're rendered. Health and stats are read from the stub_status
+// page.
+type nginxBackend struct {
+	*commandBackend
+	statusURL string
+}
+
+// nginxServer is an nginx server block, serving all services routed for the
+// same host. The default server, for services without hosts, has no Host.
+type nginxServer struct {
+	Host     string
+	Port     int
+	SslCert  string
+	Services []service
+}
+
+func newNginxBackend(cfg *loadBalancerConfig) loadBalancerBackend {
+	return &nginxBackend{
+		commandBackend: &commandBackend{
+			cfg: cfg,
+			funcs: template.FuncMap{
+				// nginx upstream names can't contain ':', since they're
+				// used in place of host:port in proxy_pass.
+				"upstream": func(name string) string {
+					return strings.Replace(name, ":", "_", -1)
+				},
+			},
+		},
+		statusURL: fmt.Sprintf("http://localhost:%v", *statsPort),
+	}
+}
+
+func (n *nginxBackend) render(w io.Writer, services map[string][]service) error {
+	return n.renderTemplate(w, map[string]interface{}{
+		"httpServices": services["httpServices"],
+		"tcpServices":  services["tcpServices"],
+		"httpServers":  groupNginxServers(services["httpServices"]),
+		"httpsServers": groupNginxServers(services["httpsServices"]),
+		"acceptProxy":  *acceptProxy,
+	})
+}
+
+// groupNginxServers adds each service to the server block of each of its
+// hosts, servers are in the order their host first appears. nginx serves a
+// single certificate per server, unlike haproxy which picks one by SNI, so
+// https services with another certificate than the first service of a
+// server are left out of it.
+func groupNginxServers(services []service) []nginxServer {
+	index := map[string]int{}
+	servers := []nginxServer{}
+	for _, s := range services {
+		hosts := s.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+		for _, host := range hosts {
+			if _, ok := index[host]; !ok {
+				index[host] = len(servers)
+				servers = append(servers, nginxServer{
+					Host:    host,
+					Port:    s.FrontendPort,
+					SslCert: s.SslCert,
+				})
+			}
+			server := &servers[index[host]]
+			if s.SslCert != server.SslCert {
+				glog.Errorf("Not serving %v over https for host %q: nginx only serves one certificate per host, %v is used",
+					s.Name, host, server.SslCert)
+				continue
+			}
+			server.Services = append(server.Services, s)
+		}
+	}
+	return servers
+}
+
+// healthz checks the nginx stub_status page.
+func (n *nginxBackend) healthz() error {
+	_, err := n.getStatus()
+	return err
+}
+
+// stats parses the nginx stub_status page. nginx only reports totals, so
+// there is a single entry called nginx. The page looks like:
+//
+//	Active connections: 291
+//	server accepts handled requests
+//	 16630948 16630948 31070465
+//	Reading: 6 Writing: 179 Waiting: 106
+func (n *nginxBackend) stats() ([]proxyStats, error) {
+	status, err := n.getStatus()
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(status, "\n")
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("unexpected nginx status %q", status)
+	}
+	var accepts, handled, requests int64
+	if _, err := fmt.Sscan(lines[2], &accepts, &handled, &requests); err != nil {
+		return nil, fmt.Errorf("unexpected nginx status %q: %v", status, err)
+	}
+	return []proxyStats{{Name: "nginx", Requests: requests}}, nil
+}
+
+func (n *nginxBackend) getStatus() (string, error) {
+	response, err := http.Get(n.statusURL)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	contents, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("nginx status returned %v: %v", response.StatusCode, string(contents))
+	}
+	return string(contents), nil
+}
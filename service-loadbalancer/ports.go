@@ -0,0 +1,208 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// lbFrontendPortKey is the service annotation the controller publishes
+	// the frontend port allocated to a tcp service on, with --tcp-port-range.
+	// It is read back so allocations survive restarts.
+	lbFrontendPortKey = "serviceloadbalancer/lb.frontend-port"
+
+	// portConflictReason is the reason of events about tcp services that
+	// didn't get a frontend port.
+	portConflictReason = "PortConflict"
+)
+
+// portRange is an inclusive range of ports.
+type portRange struct {
+	min, max int
+}
+
+// parsePortRange parses a min-max port range, an empty string means no range.
+func parsePortRange(r string) (*portRange, error) {
+	if r == "" {
+		return nil, nil
+	}
+	bounds := strings.Split(r, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid port range %q, expected min-max", r)
+	}
+	min, err := strconv.Atoi(bounds[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", r, err)
+	}
+	max, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid port range %q: %v", r, err)
+	}
+	if min < 1 || max > 65535 || min > max {
+		return nil, fmt.Errorf("invalid port range %q", r)
+	}
+	return &portRange{min, max}, nil
+}
+
+func (r *portRange) contains(port int) bool {
+	return port >= r.min && port <= r.max
+}
+
+// tcpCandidate is a tcp service waiting for a frontend port.
+type tcpCandidate struct {
+	s           api.Service
+	servicePort api.ServicePort
+	svc         service
+}
+
+type byCandidateName []tcpCandidate
+
+func (c byCandidateName) Len() int           { return len(c) }
+func (c byCandidateName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byCandidateName) Less(i, j int) bool { return c[i].svc.Name < c[j].svc.Name }
+
+// reservedPorts returns the ports of the loadbalancer that tcp services
+// can't take, and what uses them.
+func (lbc *loadBalancerController) reservedPorts() map[int]string {
+	reserved := map[int]string{
+		lbc.httpPort: "the http frontend",
+		healthzPort:  "the healthz server",
+		*statsPort:   "the stats page",
+	}
+	if lbc.httpsPort != 0 {
+		reserved[lbc.httpsPort] = "the https frontend"
+	}
+	return reserved
+}
+
+// assignTCPPorts sets the frontend port of the given tcp services. Without a
+// --tcp-port-range it's the service port, and a service whose port is taken,
+// by another service or the loadbalancer itself, is rejected. Services are
+// considered in name order, so the same service wins every sync. With a
+// range, ports are allocated from it, keeping the port published on the
+// service if it's still free. Rejected services are reported with an event,
+// and both outcomes end up in the service status.
+func (lbc *loadBalancerController) assignTCPPorts(candidates []tcpCandidate) (tcpSvc []service) {
+	sort.Sort(byCandidateName(candidates))
+	taken := lbc.reservedPorts()
+	if lbc.tcpPortRange == nil {
+		for _, c := range candidates {
+			if owner, ok := taken[c.svc.FrontendPort]; ok {
+				lbc.rejectTCPService(&c, fmt.Sprintf("port %v is taken by %v", c.svc.FrontendPort, owner))
+				continue
+			}
+			taken[c.svc.FrontendPort] = c.svc.Name
+			lbc.acceptTCPService(&c)
+			tcpSvc = append(tcpSvc, c.svc)
+		}
+		return tcpSvc
+	}
+
+	// Keep existing allocations first, so a new service can't steal them.
+	ports := make([]int, len(candidates))
+	for i, c := range candidates {
+		port, ok := lbc.allocatedPorts[c.svc.Name]
+		if published, err := strconv.Atoi(c.s.Annotations[lbFrontendPortKey]); err == nil {
+			port, ok = published, true
+		}
+		if _, used := taken[port]; ok && !used && lbc.tcpPortRange.contains(port) {
+			ports[i] = port
+			taken[port] = c.svc.Name
+		}
+	}
+	// Only the current candidates are remembered, so services that are gone
+	// don't hold on to their ports.
+	allocated, unpublished := map[string]int{}, map[string]int{}
+	next := lbc.tcpPortRange.min
+	for i, c := range candidates {
+		if ports[i] == 0 {
+			for taken[next] != "" && next <= lbc.tcpPortRange.max {
+				next++
+			}
+			if next > lbc.tcpPortRange.max {
+				lbc.rejectTCPService(&c, fmt.Sprintf("no free port in %v-%v", lbc.tcpPortRange.min, lbc.tcpPortRange.max))
+				continue
+			}
+			ports[i] = next
+			taken[next] = c.svc.Name
+		}
+		c.svc.FrontendPort = ports[i]
+		allocated[c.svc.Name] = ports[i]
+		if c.s.Annotations[lbFrontendPortKey] != strconv.Itoa(ports[i]) {
+			unpublished[fmt.Sprintf("%v/%v", c.s.Namespace, c.s.Name)] = ports[i]
+		}
+		lbc.acceptTCPService(&c)
+		tcpSvc = append(tcpSvc, c.svc)
+	}
+	lbc.allocatedPorts, lbc.unpublishedPorts = allocated, unpublished
+	return tcpSvc
+}
+
+func (lbc *loadBalancerController) rejectTCPService(c *tcpCandidate, reason string) {
+	glog.Errorf("Ignoring tcp service %v: %v", c.svc.Name, reason)
+	lbc.eventf(&c.s, portConflictReason, "Not loadbalancing port %v: %v", c.svc.FrontendPort, reason)
+	lbc.setPortSkipped(&c.s, &c.servicePort, reason)
+}
+
+func (lbc *loadBalancerController) acceptTCPService(c *tcpCandidate) {
+	lbc.setPortURL(&c.s, c.servicePort.Port, api.ProtocolTCP, lbc.getL4URL(api.ProtocolTCP, c.svc.FrontendPort))
+}
+
+// publishFrontendPorts writes the frontend ports allocated since the last
+// call to the services, in key order, ports that can't be published are
+// retried on the next call.
+func (lbc *loadBalancerController) publishFrontendPorts() {
+	keys := []string{}
+	for key := range lbc.unpublishedPorts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		port := lbc.unpublishedPorts[key]
+		parts := strings.SplitN(key, "/", 2)
+		err := lbc.annotateService(parts[0], parts[1], lbFrontendPortKey, strconv.Itoa(port))
+		if err != nil {
+			glog.Errorf("Unable to publish frontend port %v of %v: %v", port, key, err)
+			continue
+		}
+		delete(lbc.unpublishedPorts, key)
+	}
+}
+
+// annotateService sets an annotation on the given service.
+func (lbc *loadBalancerController) annotateService(namespace, name, key, value string) error {
+	s, err := lbc.svcClient.Services(namespace).Get(name)
+	if err != nil {
+		return err
+	}
+	if s.Annotations == nil {
+		s.Annotations = map[string]string{}
+	}
+	if s.Annotations[key] == value {
+		return nil
+	}
+	s.Annotations[key] = value
+	_, err = lbc.svcClient.Services(namespace).Update(s)
+	return err
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/testclient"
+)
+
+func TestParsePortRange(t *testing.T) {
+	for r, expected := range map[string]*portRange{
+		"":          nil,
+		"9000-9099": {9000, 9099},
+		"9000":      nil,
+		"9099-9000": nil,
+		"0-10":      nil,
+		"a-b":       nil,
+	} {
+		got, err := parsePortRange(r)
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected %v to parse to %+v, got %+v", r, expected, got)
+		}
+		if err == nil && expected == nil && r != "" {
+			t.Errorf("Expected an error parsing %v", r)
+		}
+	}
+}
+
+// getTCPCandidate returns a tcp service called name asking for port.
+func getTCPCandidate(name string, port int, annotations map[string]string) tcpCandidate {
+	return tcpCandidate{
+		s:   api.Service{ObjectMeta: api.ObjectMeta{Name: name, Namespace: ns, Annotations: annotations}},
+		svc: service{Name: name, FrontendPort: port},
+	}
+}
+
+// frontendPorts returns the frontend port of each service by name.
+func frontendPorts(svcs []service) map[string]int {
+	ports := map[string]int{}
+	for _, svc := range svcs {
+		ports[svc.Name] = svc.FrontendPort
+	}
+	return ports
+}
+
+func TestAssignTCPPortsConflicts(t *testing.T) {
+	flb := newFakeLoadBalancerController(nil, nil)
+	tcp := flb.assignTCPPorts([]tcpCandidate{
+		getTCPCandidate("mysql-b", 3306, nil),
+		getTCPCandidate("mysql-a", 3306, nil),
+		getTCPCandidate("web", 80, nil),
+		getTCPCandidate("redis", 6379, nil),
+	})
+	expected := map[string]int{"mysql-a": 3306, "redis": 6379}
+	if ports := frontendPorts(tcp); !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Expected ports %v, got %v", expected, ports)
+	}
+	if events := flb.recorder.(*fakeEventRecorder).events; len(events) != 2 {
+		t.Errorf("Expected an event for mysql-b and web, got %v", events)
+	}
+}
+
+func TestAssignTCPPortsFromRange(t *testing.T) {
+	flb := newFakeLoadBalancerController(nil, nil)
+	flb.tcpPortRange = &portRange{9000, 9002}
+	candidates := []tcpCandidate{
+		getTCPCandidate("a", 3306, nil),
+		getTCPCandidate("b", 3306, map[string]string{lbFrontendPortKey: "9000"}),
+		getTCPCandidate("c", 6379, map[string]string{lbFrontendPortKey: "80"}),
+		getTCPCandidate("d", 6379, nil),
+	}
+	tcp := flb.assignTCPPorts(candidates)
+	// b keeps its published port, c's published port is out of range.
+	expected := map[string]int{"a": 9001, "b": 9000, "c": 9002}
+	if ports := frontendPorts(tcp); !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Expected ports %v, got %v", expected, ports)
+	}
+	if events := flb.recorder.(*fakeEventRecorder).events; len(events) != 1 {
+		t.Errorf("Expected an event for d, got %v", events)
+	}
+
+	// The fake client returns its only service whatever the name, so match
+	// each update with the name passed to the get before it.
+	fake := testclient.NewSimpleFake(&api.Service{ObjectMeta: api.ObjectMeta{Name: "any", Namespace: ns}})
+	flb.svcClient = fake
+	flb.publishFrontendPorts()
+	published := map[string]string{}
+	name := ""
+	for _, action := range fake.Actions() {
+		switch action := action.(type) {
+		case testclient.GetAction:
+			name = action.GetName()
+		case testclient.UpdateAction:
+			published[name] = action.GetObject().(*api.Service).Annotations[lbFrontendPortKey]
+		}
+	}
+	if expected := map[string]string{"a": "9001", "c": "9002"}; !reflect.DeepEqual(published, expected) {
+		t.Errorf("Expected published ports %v, got %v", expected, published)
+	}
+	if len(flb.unpublishedPorts) != 0 {
+		t.Errorf("Expected all ports to be published, got %v", flb.unpublishedPorts)
+	}
+
+	// Allocations are stable, even before they are published.
+	candidates[0].s.Annotations = nil
+	if ports := frontendPorts(flb.assignTCPPorts(candidates)); !reflect.DeepEqual(ports, expected) {
+		t.Errorf("Expected ports %v, got %v", expected, ports)
+	}
+
+	// Services that are gone lose their allocation.
+	flb.assignTCPPorts(candidates[1:])
+	if _, ok := flb.allocatedPorts["a"]; ok {
+		t.Errorf("Expected the port of a to be released, got %v", flb.allocatedPorts)
+	}
+}
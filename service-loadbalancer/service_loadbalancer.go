@@ -17,20 +17,22 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
 	flag "github.com/spf13/pflag"
 	"k8s.io/kubernetes/pkg/api"
 	"k8s.io/kubernetes/pkg/client"
@@ -46,11 +48,27 @@ const (
 	reloadQPS    = 10.0
 	resyncPeriod = 10 * time.Second
 	healthzPort  = 8081
+
+	// lbHostKey is the service annotation holding a comma separated list of
+	// hostnames. Http requests for these hosts are routed to the service.
+	lbHostKey = "serviceloadbalancer/lb.host"
+
+	// lbPathKey is the service annotation holding a custom url prefix used to
+	// route http requests to the service, instead of /serviceName.
+	lbPathKey = "serviceloadbalancer/lb.path"
+
+	// routeConflictReason is the reason of events about http services whose
+	// route is already taken by another service.
+	routeConflictReason = "RouteConflict"
 )
 
 var (
 	flags = flag.NewFlagSet("", flag.ContinueOnError)
 
+	// validPath matches the url prefixes allowed in the lbPathKey annotation,
+	// they end up unquoted in the regexes of the loadbalancer config.
+	validPath = regexp.MustCompile(`^/[A-Za-z0-9/_.-]*$`)
+
 	// keyFunc for endpoints and services.
 	keyFunc = framework.DeletionHandlingMetaNamespaceKeyFunc
 
@@ -69,24 +87,71 @@ var (
 		cluster for creating the client`)
 
 	// If you have pure tcp services or https services that need L3 routing, you
-	// must specify them by name. Note that you are responsible for:
-	// 1. Making sure there is no collision between the service ports of these services.
-	//	- You can have multiple <mysql svc name>:3306 specifications in this map, and as
-	//	  long as the service ports of your mysql service don't clash, you'll get
-	//	  loadbalancing for each one.
-	// 2. Exposing the service ports as node ports on a pod.
-	// 3. Adding firewall rules so these ports can ingress traffic.
+	// must specify them by name. Services whose service ports collide, with
+	// each other or the ports of the loadbalancer, are rejected with an event,
+	// unless --tcp-port-range allocates frontend ports. Note that you are
+	// responsible for:
+	// 1. Exposing the frontend ports as node ports on a pod.
+	// 2. Adding firewall rules so these ports can ingress traffic.
 	//
 	// Any service not specified in this map is treated as an http:80 service,
 	// unless TargetService dictates otherwise.
 
 	tcpServices = flags.String("tcp-services", "", `Comma separated list of tcp/https
 		serviceName:servicePort pairings. This assumes you've opened up the right
-		hostPorts for each service that serves ingress traffic.`)
+		hostPorts for each service that serves ingress traffic. The serviceName
+		can be qualified as namespace/serviceName when watching all namespaces.`)
+
+	tcpPortRange = flags.String("tcp-port-range", "", `Range of frontend ports,
+		eg: 9000-9099, to allocate to tcp services instead of using their service
+		port. Each allocation is published in the serviceloadbalancer/lb.frontend-port
+		annotation of the service.`)
+
+	haVIP = flags.String("ha-vip", "", `Virtual ip shared by the replicas of the
+		loadbalancer. If set, replicas elect a leader through the kubernetes api,
+		and the leader claims the ip with --ha-vip-cmd.`)
+
+	haVIPCmd = flags.String("ha-vip-cmd", "./vip_announce", `Command run with
+		"up <vip>" when this replica becomes the leader, and "down <vip>" when it
+		stops being the leader.`)
+
+	haLock = flags.String("ha-lock", "service-loadbalancer-leader", `Name of the
+		endpoints object used as the leader election lock, in the namespace
+		whose services are loadbalanced, or default with --all-namespaces.`)
+
+	haLeaseDuration = flags.Duration("ha-lease-duration", 15*time.Second, `How
+		long a leader keeps the virtual ip without renewing its lease. Failover
+		takes at most this long.`)
+
+	externalAddress = flags.String("external-address", "", `Address clients reach
+		the loadbalancer at, used in the serviceloadbalancer/status annotation of
+		services. Defaults to --ha-vip.`)
+
+	udpServices = flags.String("udp-services", "", `Comma separated list of udp
+		serviceName:servicePort pairings, like --tcp-services. UDP services are
+		proxied by the controller itself, on the hostPorts opened for them.`)
+
+	udpMaxSessions = flags.Int("udp-max-sessions", 10000, `Maximum number of
+		udp sessions, ie: client addresses, of each udp service. Datagrams from
+		new clients are dropped beyond it, until sessions time out.`)
 
 	targetService = flags.String(
 		"target-service", "", `Restrict loadbalancing to a single target service.`)
 
+	// AllNamespaces == true:
+	// The lb watches services and endpoints across every namespace. Http
+	// services in the default namespace are still reachable at /svc, services
+	// in other namespaces are reachable at /ns/svc.
+	allNamespaces = flags.Bool("all-namespaces", false, `Watch services in all
+		namespaces instead of the namespace of the current context.`)
+
+	includeNamespaces = flags.String("include-namespaces", "", `Comma separated
+		list of namespaces to loadbalance. If empty, all watched namespaces are
+		included. Only useful with --all-namespaces.`)
+
+	excludeNamespaces = flags.String("exclude-namespaces", "", `Comma separated
+		list of namespaces to ignore. Only useful with --all-namespaces.`)
+
 	// ForwardServices == true:
 	// The lb just forwards packets to the vip of the service and we use
 	// kube-proxy's inbuilt load balancing. You get rules:
@@ -104,8 +169,14 @@ var (
 		instead of endpoints. This will use kube-proxy's inbuilt load balancing.`)
 
 	httpPort  = flags.Int("http-port", 80, `Port to expose http services.`)
+	httpsPort = flags.Int("https-port", 443, `Port to expose http services that
+		terminate ssl, see the serviceloadbalancer/lb.ssl-secret annotation.`)
 	statsPort = flags.Int("stats-port", 1936, `Port for loadbalancer stats,
 		Used in the loadbalancer liveness probe.`)
+
+	acceptProxy = flags.Bool("accept-proxy", false, `If true, the http, https and
+		tcp frontends expect the PROXY protocol, eg: behind a cloud loadbalancer
+		sending it. Clients can't connect directly then.`)
 )
 
 // service encapsulates a single backend entry in the load balancer config.
@@ -116,6 +187,59 @@ type service struct {
 	Name string
 	Ep   []string
 
+	// Path is the url prefix used to route http traffic to this service,
+	// eg: /svc or /ns/svc:8080. The prefix is stripped before the request
+	// is forwarded to the endpoints.
+	Path string
+
+	// Hosts is the list of hostnames this service is routed for. If empty,
+	// requests are routed by Path alone, regardless of the Host header.
+	Hosts []string
+
+	// SslCert is the path to the certificate bundle used to terminate ssl
+	// for this service. Only set for services on the https frontend.
+	SslCert string
+
+	// sslSecret is the namespace/name of the secret holding the certificate
+	// and key for this service, if any.
+	sslSecret string
+
+	// Algorithm is the loadbalancing algorithm used across Ep.
+	Algorithm string
+
+	// CookieStickySession is true if http clients should be pinned to an
+	// endpoint with a cookie.
+	CookieStickySession bool
+
+	// TimeoutServer is the time in milliseconds to wait for an endpoint to
+	// respond, 0 means the loadbalancer default.
+	TimeoutServer int
+
+	// SendProxy is the version of the PROXY protocol, v1 or v2, sent to
+	// the endpoints of a tcp service, empty to send none.
+	SendProxy string
+
+	// ForwardedHeaders is true if requests to the endpoints of an http
+	// service carry X-Forwarded-For, X-Forwarded-Proto and X-Forwarded-Port.
+	ForwardedHeaders bool
+
+	// AllowCIDRs and DenyCIDRs restrict the clients that can reach the
+	// service by source address, empty lists don't restrict anything.
+	AllowCIDRs []string
+	DenyCIDRs  []string
+
+	// RateLimit is the number of requests, or connections for tcp
+	// services, per second allowed for each client, 0 means no limit.
+	RateLimit int
+
+	// HealthCheck configures active health checks of Ep, nil if the
+	// endpoints aren't checked.
+	HealthCheck *healthCheck
+
+	// Weights is the relative weight of each endpoint in Ep, nil if they
+	// all get an equal share. Only services with canaries are weighted.
+	Weights map[string]int
+
 	// FrontendPort is the port that the loadbalancer listens on for traffic
 	// for this service. For http, it's always :80, for each tcp service it
 	// is the service port of any service matching a name in the tcpServices set.
@@ -123,43 +247,167 @@ type service struct {
 }
 
 // loadBalancerConfig represents loadbalancer specific configuration. Eventually
-// kubernetes will have an api for l7 loadbalancing.
+// kubernetes will have an api for l7 loadbalancing. Empty fields are filled in
+// with the defaults of the backend named by Name.
 type loadBalancerConfig struct {
-	Name      string `json:"name" description:"Name of the load balancer, eg: haproxy."`
-	ReloadCmd string `json:"reloadCmd" description:"command used to reload the load balancer."`
-	Config    string `json:"config" description:"path to loadbalancers configuration file."`
-	Template  string `json:"template" description:"template for the load balancer config."`
-	Algorithm string `json:"algorithm" description:"loadbalancing algorithm."`
+	Name        string `json:"name" description:"Name of the load balancer, eg: haproxy or nginx."`
+	ReloadCmd   string `json:"reloadCmd" description:"command used to reload the load balancer."`
+	ValidateCmd string `json:"validateCmd" description:"optional command used to validate a config before it is used, the path to the config is appended."`
+	Config      string `json:"config" description:"path to loadbalancers configuration file."`
+	Template    string `json:"template" description:"template for the load balancer config."`
+	Algorithm   string `json:"algorithm" description:"loadbalancing algorithm."`
+
+	backend loadBalancerBackend
+}
+
+// configValidationError indicates that the rendered config was rejected by the
+// validateCmd, retrying won't help until the services change.
+type configValidationError struct {
+	name     string
+	rejected string
+	output   string
+	err      error
+}
+
+func (e *configValidationError) Error() string {
+	return fmt.Sprintf("%v rejected config, saved as %v: %v\n%v", e.name, e.rejected, e.err, e.output)
 }
 
-// write writes the configuration file, will write to stdout if dryRun == true
-func (cfg *loadBalancerConfig) write(services map[string][]service, dryRun bool) (err error) {
-	var w io.Writer
+// write renders the configuration file, will write to stdout if dryRun == true.
+// The file is only replaced if the rendered config differs from its current
+// contents, in which case changed is true and the difference is logged. If a
+// validateCmd is configured, a config it rejects is saved next to the current
+// one with a .rejected suffix, and the current config is left in place.
+func (cfg *loadBalancerConfig) write(services map[string][]service, dryRun bool) (changed bool, err error) {
+	var rendered bytes.Buffer
+	if err := cfg.backend.render(&rendered, services); err != nil {
+		return false, err
+	}
 	if dryRun {
-		w = os.Stdout
-	} else {
-		w, err = os.Create(cfg.Config)
-		if err != nil {
-			return
+		_, err := rendered.WriteTo(os.Stdout)
+		return false, err
+	}
+	debug.recordConfig(rendered.Bytes())
+	current, err := ioutil.ReadFile(cfg.Config)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if bytes.Equal(current, rendered.Bytes()) {
+		cfg.accept()
+		return false, nil
+	}
+	glog.Infof("%v config changed:\n%v", cfg.Name, diffLines(string(current), rendered.String()))
+	if err := writeFileAtomic(cfg.Config, rendered.Bytes(), 0644, cfg.backend.validate); err != nil {
+		if verr, ok := err.(*configValidationError); ok {
+			configValidationErrors.Inc()
+			if err := ioutil.WriteFile(verr.rejected, rendered.Bytes(), 0644); err != nil {
+				glog.Errorf("Unable to save rejected config %v: %v", verr.rejected, err)
+			}
 		}
+		return false, err
 	}
-	var t *template.Template
-	t, err = template.ParseFiles(cfg.Template)
-	if err != nil {
-		return
+	cfg.accept()
+	return true, nil
+}
+
+// accept tells the backend the last rendered config is on disk.
+func (cfg *loadBalancerConfig) accept() {
+	if acceptor, ok := cfg.backend.(configAcceptor); ok {
+		acceptor.accept()
 	}
-	return t.Execute(w, services)
 }
 
-// reload reloads the loadbalancer using the reload cmd specified in the json manifest.
-func (cfg *loadBalancerConfig) reload() error {
-	output, err := exec.Command("sh", "-c", cfg.ReloadCmd).CombinedOutput()
-	msg := fmt.Sprintf("%v -- %v", cfg.Name, string(output))
+// writeFileIfChanged atomically replaces the given file with data, unless it
+// already has the same contents. Returns true if the file was written.
+func writeFileIfChanged(path string, data []byte, perm os.FileMode) (bool, error) {
+	if current, err := ioutil.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	return true, writeFileAtomic(path, data, perm, nil)
+}
+
+// writeFileAtomic stages data in a temporary file next to path and renames it
+// over path. If validate is not nil, it is called with the staged file and
+// path is left untouched if it returns an error.
+func writeFileAtomic(path string, data []byte, perm os.FileMode, validate func(string) error) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
 	if err != nil {
-		return fmt.Errorf("Error restarting %v: %v", msg, err)
+		return err
 	}
-	glog.Infof(msg)
-	return nil
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	if validate != nil {
+		if err := validate(tmp.Name()); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// maxDiffCells bounds the size of the table diffLines computes, past it only
+// the number of differing lines is reported.
+const maxDiffCells = 1 << 20
+
+// diffLines returns the lines that differ between a and b, lines only in a are
+// prefixed with "-" and lines only in b with "+".
+func diffLines(a, b string) string {
+	aLines, bLines := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// Most changes touch a few lines, only diff what's between the common
+	// prefix and suffix.
+	for len(aLines) > 0 && len(bLines) > 0 && aLines[0] == bLines[0] {
+		aLines, bLines = aLines[1:], bLines[1:]
+	}
+	for len(aLines) > 0 && len(bLines) > 0 && aLines[len(aLines)-1] == bLines[len(bLines)-1] {
+		aLines, bLines = aLines[:len(aLines)-1], bLines[:len(bLines)-1]
+	}
+	if (len(aLines)+1)*(len(bLines)+1) > maxDiffCells {
+		return fmt.Sprintf("%v lines replaced by %v lines, too many to diff\n", len(aLines), len(bLines))
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of
+	// aLines[i:] and bLines[j:].
+	lcs := make([][]int, len(aLines)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bLines)+1)
+	}
+	for i := len(aLines) - 1; i >= 0; i-- {
+		for j := len(bLines) - 1; j >= 0; j-- {
+			if aLines[i] == bLines[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var diff bytes.Buffer
+	i, j := 0, 0
+	for i < len(aLines) || j < len(bLines) {
+		switch {
+		case i < len(aLines) && j < len(bLines) && aLines[i] == bLines[j]:
+			i++
+			j++
+		case j < len(bLines) && (i == len(aLines) || lcs[i][j+1] >= lcs[i+1][j]):
+			fmt.Fprintf(&diff, "+%v\n", bLines[j])
+			j++
+		default:
+			fmt.Fprintf(&diff, "-%v\n", aLines[i])
+			i++
+		}
+	}
+	return diff.String()
 }
 
 // loadBalancerController watches the kubernetes api and adds/removes services
@@ -167,17 +415,42 @@ func (cfg *loadBalancerConfig) reload() error {
 type loadBalancerController struct {
 	cfg               *loadBalancerConfig
 	queue             *workqueue.Type
-	client            *client.Client
+	svcClient         client.ServicesNamespacer
 	epController      *framework.Controller
 	svcController     *framework.Controller
+	secretController  *framework.Controller
+	podController     *framework.Controller
 	svcLister         cache.StoreToServiceLister
 	epLister          cache.StoreToEndpointsLister
+	secretStore       cache.Store
+	podStore          cache.Store
+	recorder          eventRecorder
 	reloadRateLimiter util.RateLimiter
-	template          string
-	targetService     string
-	forwardServices   bool
-	tcpServices       map[string]int
+	// reloadPending is true if the config on disk has changed since the
+	// last successful reload. It starts out true, since the loadbalancer
+	// might not be running the config on disk yet.
+	reloadPending    bool
+	template         string
+	targetService    string
+	forwardServices  bool
+	tcpServices      map[string]int
+	tcpPortRange     *portRange
+	allocatedPorts   map[string]int
+	unpublishedPorts map[string]int
+	udpServices      map[string]int
+	udpProxy         *udpProxy
+	// isLeader returns true if this replica should write to the apiserver,
+	// only the leader does with --ha-vip.
+	isLeader          func() bool
 	httpPort          int
+	httpsPort         int
+	allNamespaces     bool
+	includeNamespaces util.StringSet
+	excludeNamespaces util.StringSet
+	// externalAddress is the host of the urls in service statuses.
+	externalAddress string
+	// statuses holds the status of each service seen by the last sync.
+	statuses map[string]*serviceStatus
 }
 
 // getEndpoints returns a list of <endpoint ip>:<port> for a given service/target port combination.
@@ -193,6 +466,10 @@ func (lbc *loadBalancerController) getEndpoints(
 	// the target port are capable of service traffic for it.
 	for _, ss := range ep.Subsets {
 		for _, epPort := range ss.Ports {
+			// A port number can serve both tcp and udp, eg: dns.
+			if protocolOrTCP(epPort.Protocol) != protocolOrTCP(servicePort.Protocol) {
+				continue
+			}
 			var targetPort int
 			switch servicePort.TargetPort.Kind {
 			case util.IntstrInt:
@@ -215,128 +492,433 @@ func (lbc *loadBalancerController) getEndpoints(
 	return
 }
 
+// protocolOrTCP returns the given protocol, defaulting to tcp like the
+// apiserver does.
+func protocolOrTCP(protocol api.Protocol) api.Protocol {
+	if protocol == "" {
+		return api.ProtocolTCP
+	}
+	return protocol
+}
+
 // encapsulates all the hacky convenience type name modifications for lb rules.
-// - :80 services don't need a :80 postfix
-// - default ns should be accessible without /ns/name (when we have /ns support)
-func getServiceNameForLBRule(s *api.Service, servicePort int) string {
+//   - :80 services don't need a :80 postfix
+//   - default ns should be accessible without /ns/name
+//   - services in other namespaces are prefixed with ns_ when watching all
+//     namespaces, so backend names stay unique (namespaces can't contain _)
+func (lbc *loadBalancerController) getServiceNameForLBRule(s *api.Service, servicePort int) string {
+	name := s.Name
+	if lbc.isNamespaceQualified(s) {
+		name = fmt.Sprintf("%v_%v", s.Namespace, s.Name)
+	}
 	if servicePort == 80 {
-		return s.Name
+		return name
 	}
-	return fmt.Sprintf("%v:%v", s.Name, servicePort)
+	return fmt.Sprintf("%v:%v", name, servicePort)
 }
 
+// getServicePathForLBRule returns the url prefix for a service, i.e /name for
+// services in the default namespace and /ns/name for all others.
+func (lbc *loadBalancerController) getServicePathForLBRule(s *api.Service, servicePort int) string {
+	path := "/" + s.Name
+	if lbc.isNamespaceQualified(s) {
+		path = fmt.Sprintf("/%v/%v", s.Namespace, s.Name)
+	}
+	if servicePort == 80 {
+		return path
+	}
+	return fmt.Sprintf("%v:%v", path, servicePort)
+}
+
+// isNamespaceQualified returns true if the lb rules of the given service need
+// to include its namespace.
+func (lbc *loadBalancerController) isNamespaceQualified(s *api.Service) bool {
+	return lbc.allNamespaces && s.Namespace != api.NamespaceDefault
+}
+
+// isNamespaceIgnored returns true if services in the given namespace should
+// not be loadbalanced, as dictated by the include/exclude namespace lists.
+func (lbc *loadBalancerController) isNamespaceIgnored(namespace string) bool {
+	if len(lbc.includeNamespaces) != 0 && !lbc.includeNamespaces.Has(namespace) {
+		return true
+	}
+	return lbc.excludeNamespaces.Has(namespace)
+}
+
+// matchesServiceName returns true if name refers to the given service, either
+// as a bare service name or qualified as namespace/name.
+func matchesServiceName(s *api.Service, name string) bool {
+	return name == s.Name || name == fmt.Sprintf("%v/%v", s.Namespace, s.Name)
+}
+
+// getTCPServicePort returns the frontend port specified for the given service
+// in the tcpServices map, the namespace qualified name takes precedence.
+func (lbc *loadBalancerController) getTCPServicePort(s *api.Service) (int, bool) {
+	return lookupServicePort(lbc.tcpServices, s)
+}
+
+// getUDPServicePort is getTCPServicePort for the udpServices map.
+func (lbc *loadBalancerController) getUDPServicePort(s *api.Service) (int, bool) {
+	return lookupServicePort(lbc.udpServices, s)
+}
+
+func lookupServicePort(ports map[string]int, s *api.Service) (int, bool) {
+	if port, ok := ports[fmt.Sprintf("%v/%v", s.Namespace, s.Name)]; ok {
+		return port, true
+	}
+	port, ok := ports[s.Name]
+	return port, ok
+}
+
+// getHTTPRoute returns the hostnames and url prefix for a service port, taking
+// the lbHostKey and lbPathKey annotations into account. Services routed by
+// host are served from / unless they also specify a path.
+func (lbc *loadBalancerController) getHTTPRoute(s *api.Service, servicePort int) (hosts []string, path string) {
+	for _, host := range strings.Split(s.Annotations[lbHostKey], ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if !util.IsDNS1123Subdomain(host) {
+			lbc.reportInvalidAnnotation(s, lbHostKey, host, fmt.Errorf("not a valid hostname"))
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	path = lbc.getServicePathForLBRule(s, servicePort)
+	if len(hosts) != 0 {
+		path = "/"
+	}
+	if customPath, ok := s.Annotations[lbPathKey]; ok {
+		if !validPath.MatchString(customPath) {
+			lbc.reportInvalidAnnotation(s, lbPathKey, customPath,
+				fmt.Errorf("must start with / and only contain letters, digits, /, _, . and -"))
+		} else {
+			path = customPath
+		}
+	}
+	return
+}
+
+// httpCandidate is an http service waiting for its route.
+type httpCandidate struct {
+	s           api.Service
+	servicePort api.ServicePort
+	svc         service
+}
+
+type byHTTPCandidateName []httpCandidate
+
+func (c byHTTPCandidateName) Len() int           { return len(c) }
+func (c byHTTPCandidateName) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byHTTPCandidateName) Less(i, j int) bool { return c[i].svc.Name < c[j].svc.Name }
+
+// assignHTTPRoutes returns the given http services, except those routing a
+// host and path another service already routes. Services are considered in
+// name order, so the same service wins every sync, and rejected services are
+// reported with an event and in the service status.
+func (lbc *loadBalancerController) assignHTTPRoutes(candidates []httpCandidate) (httpSvc []service) {
+	sort.Sort(byHTTPCandidateName(candidates))
+	taken := map[string]string{}
+	for _, c := range candidates {
+		hosts := c.svc.Hosts
+		if len(hosts) == 0 {
+			hosts = []string{""}
+		}
+		owner := ""
+		for _, host := range hosts {
+			if owner = taken[host+c.svc.Path]; owner != "" {
+				break
+			}
+		}
+		if owner != "" {
+			reason := fmt.Sprintf("route %v is taken by %v", lbc.getHTTPURL(&c.svc), owner)
+			glog.Errorf("Ignoring http service %v: %v", c.svc.Name, reason)
+			lbc.eventf(&c.s, routeConflictReason, "Not loadbalancing port %v: %v", c.servicePort.Port, reason)
+			lbc.setPortSkipped(&c.s, &c.servicePort, reason)
+			continue
+		}
+		for _, host := range hosts {
+			taken[host+c.svc.Path] = c.svc.Name
+		}
+		lbc.setPortURL(&c.s, c.servicePort.Port, api.ProtocolTCP, lbc.getHTTPURL(&c.svc))
+		httpSvc = append(httpSvc, c.svc)
+	}
+	return httpSvc
+}
+
+// byRouteSpecificity sorts services so the most specific routes come first:
+// host routes before plain url routes, and longer url prefixes before shorter
+// ones. This ensures /ns/svc is matched before /ns if there's a service called ns.
+// Ties are broken by name, so the config doesn't change with the store order.
+type byRouteSpecificity []service
+
+func (s byRouteSpecificity) Len() int      { return len(s) }
+func (s byRouteSpecificity) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byRouteSpecificity) Less(i, j int) bool {
+	if (len(s[i].Hosts) == 0) != (len(s[j].Hosts) == 0) {
+		return len(s[i].Hosts) != 0
+	}
+	if len(s[i].Path) != len(s[j].Path) {
+		return len(s[i].Path) > len(s[j].Path)
+	}
+	return s[i].Name < s[j].Name
+}
+
+// byName sorts services by name, so the config doesn't change with the store
+// order.
+type byName []service
+
+func (s byName) Len() int           { return len(s) }
+func (s byName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byName) Less(i, j int) bool { return s[i].Name < s[j].Name }
+
 // getServices returns a list of services and their endpoints.
-func (lbc *loadBalancerController) getServices() (httpSvc []service, tcpSvc []service) {
-	ep := []string{}
+func (lbc *loadBalancerController) getServices() (httpSvc []service, tcpSvc []service, udpSvc []service) {
+	tcpCandidates := []tcpCandidate{}
+	httpCandidates := []httpCandidate{}
+	lbc.statuses = map[string]*serviceStatus{}
 	services, _ := lbc.svcLister.List()
-	for _, s := range services.Items {
+	canaries := lbc.getCanaries(services.Items)
+	canaryOf := map[string]canary{}
+	for _, cs := range canaries {
+		for _, c := range cs {
+			canaryOf[fmt.Sprintf("%v/%v", c.s.Namespace, c.s.Name)] = c
+		}
+	}
+	for i := range services.Items {
+		s := services.Items[i]
+		key := fmt.Sprintf("%v/%v", s.Namespace, s.Name)
+		if lbc.isNamespaceIgnored(s.Namespace) {
+			glog.Infof("Ignoring service %v, namespace %v is not loadbalanced", s.Name, s.Namespace)
+			continue
+		}
+		if lbc.targetService != "" && !matchesServiceName(&s, lbc.targetService) {
+			glog.Infof("Ignoring %v, it is not the target service", s.Name)
+			continue
+		}
 		if s.Spec.Type == api.ServiceTypeLoadBalancer {
 			glog.Infof("Ignoring service %v, it already has a loadbalancer", s.Name)
+			lbc.setSkipped(&s, "service has a cloud loadbalancer")
+			continue
+		}
+		if c, ok := canaryOf[key]; ok {
+			glog.Infof("Service %v is a canary of %v", s.Name, c.primary)
+			lbc.setSkipped(&s, fmt.Sprintf("canary receiving %v%% of the traffic of %v", c.weight, c.primary))
 			continue
 		}
 		for _, servicePort := range s.Spec.Ports {
-			// TODO: headless services?
 			sName := s.Name
-			if servicePort.Protocol == api.ProtocolUDP ||
-				(lbc.targetService != "" && lbc.targetService != sName) {
-				glog.Infof("Ignoring %v: %+v", sName, servicePort)
+			if port, ok := lbc.getUDPServicePort(&s); servicePort.Protocol == api.ProtocolUDP &&
+				(!ok || port != servicePort.Port) {
+				glog.Infof("Ignoring %v: %+v, it is not in --udp-services", sName, servicePort)
+				lbc.setPortSkipped(&s, &servicePort, "udp port not in --udp-services")
 				continue
 			}
 
-			if lbc.forwardServices {
-				ep = []string{
-					fmt.Sprintf("%v:%v", s.Spec.ClusterIP, servicePort.Port)}
-			} else {
-				ep = lbc.getEndpoints(&s, &servicePort)
+			ep := lbc.getServiceEndpoints(&s, &servicePort)
+			var weights map[string]int
+			// The udp proxy doesn't weigh endpoints.
+			if servicePort.Protocol != api.ProtocolUDP {
+				ep, weights = lbc.addCanaries(&servicePort, ep, canaries[key])
 			}
 			if len(ep) == 0 {
 				glog.Infof("No endpoints found for service %v, port %+v",
 					sName, servicePort)
+				lbc.setPortSkipped(&s, &servicePort, "no endpoints")
 				continue
 			}
 			newSvc := service{
-				Name: getServiceNameForLBRule(&s, servicePort.Port),
-				Ep:   ep,
+				Name:    lbc.getServiceNameForLBRule(&s, servicePort.Port),
+				Ep:      ep,
+				Weights: weights,
+			}
+			if err := lbc.setServiceSettings(&s, &newSvc); err != nil {
+				glog.Errorf("Ignoring %v: %+v, %v", sName, servicePort, err)
+				lbc.setPortSkipped(&s, &servicePort, err.Error())
+				continue
+			}
+			if !lbc.forwardServices || isHeadless(&s) {
+				newSvc.HealthCheck = lbc.getHealthCheck(&s, &servicePort)
 			}
-			if port, ok := lbc.tcpServices[sName]; ok && port == servicePort.Port {
+			if servicePort.Protocol == api.ProtocolUDP {
 				newSvc.FrontendPort = servicePort.Port
-				tcpSvc = append(tcpSvc, newSvc)
+				udpSvc = append(udpSvc, newSvc)
+				lbc.setPortURL(&s, servicePort.Port, api.ProtocolUDP, lbc.getL4URL(api.ProtocolUDP, newSvc.FrontendPort))
+			} else if port, ok := lbc.getTCPServicePort(&s); ok && port == servicePort.Port {
+				newSvc.FrontendPort = servicePort.Port
+				tcpCandidates = append(tcpCandidates, tcpCandidate{s: s, servicePort: servicePort, svc: newSvc})
 			} else {
 				newSvc.FrontendPort = lbc.httpPort
-				httpSvc = append(httpSvc, newSvc)
+				newSvc.Hosts, newSvc.Path = lbc.getHTTPRoute(&s, servicePort.Port)
+				if secret := getSslSecret(&s); secret != "" && lbc.checkSslSecret(&s, secret) {
+					newSvc.sslSecret = secret
+				}
+				httpCandidates = append(httpCandidates, httpCandidate{s: s, servicePort: servicePort, svc: newSvc})
 			}
 			glog.Infof("Found service: %+v", newSvc)
 		}
 	}
+	tcpSvc = lbc.assignTCPPorts(tcpCandidates)
+	httpSvc = lbc.assignHTTPRoutes(httpCandidates)
+	lbc.sortStatuses()
+	sort.Sort(byRouteSpecificity(httpSvc))
+	sort.Sort(byName(tcpSvc))
 	return
 }
 
 // sync all services with the loadbalancer.
 func (lbc *loadBalancerController) sync(dryRun bool) error {
-	if !lbc.epController.HasSynced() || !lbc.svcController.HasSynced() {
+	if !lbc.epController.HasSynced() || !lbc.svcController.HasSynced() ||
+		!lbc.secretController.HasSynced() || !lbc.podController.HasSynced() {
 		time.Sleep(100 * time.Millisecond)
 		return deferredSync
 	}
-	httpSvc, tcpSvc := lbc.getServices()
+	httpSvc, tcpSvc, udpSvc := lbc.getServices()
+	if !dryRun && lbc.isLeader() {
+		lbc.publishStatuses()
+	}
+	if dryRun {
+		for _, svc := range udpSvc {
+			fmt.Printf("udp service %v: :%v -> %v\n", svc.Name, svc.FrontendPort, svc.Ep)
+		}
+	} else {
+		lbc.udpProxy.update(udpSvc)
+	}
 	if len(httpSvc) == 0 && len(tcpSvc) == 0 {
+		recordServices(map[string][]service{"udpServices": udpSvc})
+		debug.recordServices(map[string][]service{"udpServices": udpSvc})
 		return nil
 	}
-	if err := lbc.cfg.write(
-		map[string][]service{
-			"httpServices": httpSvc,
-			"tcpServices":  tcpSvc,
-		}, dryRun); err != nil {
+	httpsSvc, certs, err := lbc.syncCerts(httpSvc, dryRun)
+	if err != nil {
+		return err
+	}
+	services := map[string][]service{
+		"httpServices":  httpSvc,
+		"httpsServices": httpsSvc,
+		"tcpServices":   tcpSvc,
+	}
+	allServices := map[string][]service{
+		"httpServices":  httpSvc,
+		"httpsServices": httpsSvc,
+		"tcpServices":   tcpSvc,
+		"udpServices":   udpSvc,
+	}
+	recordServices(allServices)
+	debug.recordServices(allServices)
+	cfgChanged, err := lbc.cfg.write(services, dryRun)
+	if err != nil {
 		return err
 	}
 	if dryRun {
 		return nil
 	}
+	if err := lbc.removeStaleCerts(certs); err != nil {
+		glog.Errorf("Unable to remove unused certificate bundles: %v", err)
+	}
+	if lbc.isLeader() {
+		lbc.publishFrontendPorts()
+	}
+	if cfgChanged {
+		lbc.reloadPending = true
+	}
+	if !lbc.reloadPending {
+		glog.V(2).Infof("Skipping reload, %v config is unchanged", lbc.cfg.Name)
+		return nil
+	}
+	// A new certificate changes the bundle path in the config, so it's never
+	// applied as an endpoint update.
+	if updater, ok := lbc.cfg.backend.(endpointUpdater); ok {
+		err := updater.updateEndpoints()
+		recordEndpointUpdate(err)
+		if err == nil {
+			glog.Infof("Updated %v endpoints without a reload", lbc.cfg.Name)
+			lbc.reloadPending = false
+			return nil
+		}
+		glog.Infof("Reloading %v: %v", lbc.cfg.Name, err)
+	}
 	lbc.reloadRateLimiter.Accept()
-	return lbc.cfg.reload()
+	output, err := lbc.cfg.backend.reload()
+	recordReload(err)
+	debug.recordReload(output, err)
+	if err != nil {
+		return err
+	}
+	lbc.reloadPending = false
+	return nil
 }
 
-// worker handles the work queue.
+// worker handles the work queue, until it's shut down.
 func (lbc *loadBalancerController) worker() {
 	for {
-		key, _ := lbc.queue.Get()
+		key, quit := lbc.queue.Get()
+		if quit {
+			return
+		}
 		glog.Infof("Sync triggered by service %v", key)
-		if err := lbc.sync(false); err != nil {
-			glog.Infof("Requeuing %v because of error: %v", key, err)
-			lbc.queue.Add(key)
-		} else {
-			lbc.queue.Done(key)
+		start := time.Now()
+		err := lbc.sync(false)
+		recordSync(start, err)
+		debug.recordSync(err)
+		if err != nil {
+			if _, ok := err.(*configValidationError); ok {
+				// Requeuing would render the same invalid config, wait
+				// for the next change instead.
+				glog.Errorf("Keeping the last valid config: %v", err)
+			} else {
+				// The key is still being processed, so Add only marks it
+				// dirty and Done puts it back in the queue.
+				glog.Infof("Requeuing %v because of error: %v", key, err)
+				lbc.queue.Add(key)
+			}
 		}
+		lbc.queue.Done(key)
 	}
 }
 
+// listWatchFunc returns the source the controller lists and watches the given
+// resource, eg: "services", from.
+type listWatchFunc func(resource string) cache.ListerWatcher
+
 // newLoadBalancerController creates a new controller from the given config.
-func newLoadBalancerController(cfg *loadBalancerConfig, kubeClient *client.Client, namespace string) *loadBalancerController {
+// Services, endpoints, secrets and pods come from listWatch, kubeClient is
+// only used to write annotations and events.
+func newLoadBalancerController(cfg *loadBalancerConfig, kubeClient client.Interface, listWatch listWatchFunc, namespace string) *loadBalancerController {
 
+	recorder := newAPIEventRecorder(kubeClient)
 	lbc := loadBalancerController{
-		cfg:    cfg,
-		client: kubeClient,
-		queue:  workqueue.New(),
+		cfg:       cfg,
+		svcClient: kubeClient,
+		queue:     workqueue.New(),
+		recorder:  recorder,
 		reloadRateLimiter: util.NewTokenBucketRateLimiter(
 			reloadQPS, int(reloadQPS)),
-		targetService:   *targetService,
-		forwardServices: *forwardServices,
-		httpPort:        *httpPort,
-		tcpServices:     map[string]int{},
+		reloadPending:     true,
+		targetService:     *targetService,
+		forwardServices:   *forwardServices,
+		httpPort:          *httpPort,
+		httpsPort:         *httpsPort,
+		tcpServices:       parseServicePorts(*tcpServices, "TCP"),
+		allocatedPorts:    map[string]int{},
+		unpublishedPorts:  map[string]int{},
+		udpServices:       parseServicePorts(*udpServices, "UDP"),
+		udpProxy:          newUDPProxy(udpSessionTimeout, *udpMaxSessions),
+		allNamespaces:     namespace == api.NamespaceAll,
+		includeNamespaces: parseNamespaces(*includeNamespaces),
+		excludeNamespaces: parseNamespaces(*excludeNamespaces),
+		isLeader:          func() bool { return true },
+		externalAddress:   *externalAddress,
 	}
-
-	for _, service := range strings.Split(*tcpServices, ",") {
-		portSplit := strings.Split(service, ":")
-		if len(portSplit) != 2 {
-			glog.Errorf("Ignoring misconfigured TCP service %v", service)
-			continue
-		}
-		if port, err := strconv.Atoi(portSplit[1]); err != nil {
-			glog.Errorf("Ignoring misconfigured TCP service %v: %v", service, err)
-			continue
-		} else {
-			lbc.tcpServices[portSplit[0]] = port
-		}
+	if lbc.externalAddress == "" {
+		lbc.externalAddress = *haVIP
 	}
+	var err error
+	if lbc.tcpPortRange, err = parsePortRange(*tcpPortRange); err != nil {
+		glog.Fatalf("Invalid --tcp-port-range: %v", err)
+	}
+
 	enqueue := func(obj interface{}) {
 		key, err := keyFunc(obj)
 		if err != nil {
@@ -355,19 +937,90 @@ func newLoadBalancerController(cfg *loadBalancerConfig, kubeClient *client.Clien
 		},
 	}
 
+	// The events of deleted services don't need to be remembered.
+	svcHandlers := eventHandlers
+	svcHandlers.DeleteFunc = func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		if s, ok := obj.(*api.Service); ok {
+			recorder.forget(s)
+		}
+		enqueue(obj)
+	}
 	lbc.svcLister.Store, lbc.svcController = framework.NewInformer(
-		cache.NewListWatchFromClient(
-			lbc.client, "services", namespace, fields.Everything()),
-		&api.Service{}, resyncPeriod, eventHandlers)
+		listWatch("services"), &api.Service{}, resyncPeriod, svcHandlers)
 
+	// The leader election lock is rewritten on every renewal, and backs no
+	// service.
+	epHandlers := eventHandlers
+	if *haVIP != "" {
+		lockKey := haLockNamespace(namespace) + "/" + *haLock
+		notLock := func(obj interface{}) bool {
+			key, err := keyFunc(obj)
+			return err != nil || key != lockKey
+		}
+		epHandlers.AddFunc = func(obj interface{}) {
+			if notLock(obj) {
+				enqueue(obj)
+			}
+		}
+		epHandlers.DeleteFunc = epHandlers.AddFunc
+		epHandlers.UpdateFunc = func(old, cur interface{}) {
+			if notLock(cur) {
+				eventHandlers.UpdateFunc(old, cur)
+			}
+		}
+	}
 	lbc.epLister.Store, lbc.epController = framework.NewInformer(
-		cache.NewListWatchFromClient(
-			lbc.client, "endpoints", namespace, fields.Everything()),
-		&api.Endpoints{}, resyncPeriod, eventHandlers)
+		listWatch("endpoints"), &api.Endpoints{}, resyncPeriod, epHandlers)
+
+	// Secrets are watched so certificate rotations trigger a sync.
+	lbc.secretStore, lbc.secretController = framework.NewInformer(
+		listWatch("secrets"), &api.Secret{}, resyncPeriod, eventHandlers)
+
+	// Pods are only looked up for their readiness probes, changes to the
+	// endpoints backing a service already trigger a sync.
+	lbc.podStore, lbc.podController = framework.NewInformer(
+		listWatch("pods"), &api.Pod{}, resyncPeriod, framework.ResourceEventHandlerFuncs{})
 
 	return &lbc
 }
 
+// parseServicePorts parses a comma separated list of serviceName:servicePort
+// pairings into a map of service name to port.
+func parseServicePorts(services, protocol string) map[string]int {
+	ports := map[string]int{}
+	for _, service := range strings.Split(services, ",") {
+		if service == "" {
+			continue
+		}
+		portSplit := strings.Split(service, ":")
+		if len(portSplit) != 2 {
+			glog.Errorf("Ignoring misconfigured %v service %v", protocol, service)
+			continue
+		}
+		if port, err := strconv.Atoi(portSplit[1]); err != nil {
+			glog.Errorf("Ignoring misconfigured %v service %v: %v", protocol, service, err)
+			continue
+		} else {
+			ports[portSplit[0]] = port
+		}
+	}
+	return ports
+}
+
+// parseNamespaces parses a comma separated list of namespaces into a set.
+func parseNamespaces(namespaces string) util.StringSet {
+	set := util.NewStringSet()
+	for _, ns := range strings.Split(namespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			set.Insert(ns)
+		}
+	}
+	return set
+}
+
 // parseCfg parses the given configuration file.
 // cmd line params take precedence over config directives.
 func parseCfg(configPath string) *loadBalancerConfig {
@@ -380,34 +1033,36 @@ func parseCfg(configPath string) *loadBalancerConfig {
 	if err != nil {
 		glog.Fatalf("Unable to unmarshal json blob: %v", string(jsonBlob))
 	}
+	if cfg.backend, err = newLoadBalancerBackend(&cfg); err != nil {
+		glog.Fatalf("Unable to create loadbalancer: %v", err)
+	}
 	glog.Infof("Creating new loadbalancer: %+v", cfg)
 	return &cfg
 }
 
-// healthzServer services liveness probes.
-func healthzServer() {
+// healthzServer services liveness probes, and exports stats and metrics.
+func healthzServer(cfg *loadBalancerConfig) {
 	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		// Delegate a check to the haproxy stats service.
-		response, err := http.Get(fmt.Sprintf("http://localhost:%v", *statsPort))
-		if err != nil {
+		if err := cfg.backend.healthz(); err != nil {
 			glog.Infof("Error %v", err)
 			w.WriteHeader(http.StatusInternalServerError)
-		} else {
-			defer response.Body.Close()
-			if response.StatusCode != http.StatusOK {
-				contents, err := ioutil.ReadAll(response.Body)
-				if err != nil {
-					glog.Infof("Error reading resonse on receiving status %v: %v",
-						response.StatusCode, err)
-				}
-				glog.Infof("%v\n", string(contents))
-				w.WriteHeader(response.StatusCode)
-			} else {
-				w.WriteHeader(200)
-				w.Write([]byte("ok"))
-			}
+			return
 		}
+		w.WriteHeader(200)
+		w.Write([]byte("ok"))
 	})
+	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := cfg.backend.stats()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+	http.Handle("/metrics", prometheus.Handler())
+	http.HandleFunc("/debug/services", debug.serveServices)
+	http.HandleFunc("/debug/config", debug.serveConfig)
 	glog.Fatal(http.ListenAndServe(fmt.Sprintf(":%v", healthzPort), nil))
 }
 
@@ -426,7 +1081,7 @@ func main() {
 	if len(*tcpServices) == 0 {
 		glog.Infof("All tcp/https services will be ignored.")
 	}
-	go healthzServer()
+	go healthzServer(cfg)
 
 	var kubeClient *client.Client
 	var err error
@@ -449,11 +1104,24 @@ func main() {
 	if !specified {
 		namespace = "default"
 	}
+	if *allNamespaces {
+		namespace = api.NamespaceAll
+	}
 
-	// TODO: Handle multiple namespaces
-	lbc := newLoadBalancerController(cfg, kubeClient, namespace)
+	listWatch := func(resource string) cache.ListerWatcher {
+		return cache.NewListWatchFromClient(kubeClient, resource, namespace, fields.Everything())
+	}
+	lbc := newLoadBalancerController(cfg, kubeClient, listWatch, namespace)
 	go lbc.epController.Run(util.NeverStop)
 	go lbc.svcController.Run(util.NeverStop)
+	go lbc.secretController.Run(util.NeverStop)
+	go lbc.podController.Run(util.NeverStop)
+	registerControllerMetrics(lbc)
+	if *haVIP != "" {
+		le := newHAElector(kubeClient, haLockNamespace(namespace), *haVIP, &scriptAnnouncer{*haVIPCmd})
+		lbc.isLeader = func() bool { return le.getStatus().IsLeader }
+		go le.run()
+	}
 	if *dry {
 		dryRun(lbc)
 	} else {
@@ -18,6 +18,11 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"k8s.io/kubernetes/pkg/api"
@@ -78,11 +83,25 @@ func getService(servicePorts []api.ServicePort) *api.Service {
 	}
 }
 
+// fakeEventRecorder collects events as "reason message" strings.
+type fakeEventRecorder struct {
+	events []string
+}
+
+func (f *fakeEventRecorder) Eventf(s *api.Service, reason, messageFmt string, args ...interface{}) {
+	f.events = append(f.events, fmt.Sprintf(reason+" "+messageFmt, args...))
+}
+
 func newFakeLoadBalancerController(endpoints []*api.Endpoints, services []*api.Service) *loadBalancerController {
-	flb := loadBalancerController{}
+	flb := loadBalancerController{cfg: &loadBalancerConfig{}}
 	flb.epLister.Store = storeEps(endpoints)
 	flb.svcLister.Store = storeServices(services)
+	flb.podStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
 	flb.httpPort = 80
+	flb.allocatedPorts = map[string]int{}
+	flb.unpublishedPorts = map[string]int{}
+	flb.recorder = &fakeEventRecorder{}
+	flb.isLeader = func() bool { return true }
 	return &flb
 }
 
@@ -152,7 +171,7 @@ func TestGetServices(t *testing.T) {
 	flb.tcpServices = map[string]int{
 		svc1.Name: 20,
 	}
-	http, tcp := flb.getServices()
+	http, tcp, _ := flb.getServices()
 	serviceURLEp := fmt.Sprintf("%v:%v", svc1.Name, 20)
 	if len(tcp) != 1 || tcp[0].Name != serviceURLEp || tcp[0].FrontendPort != 20 {
 		t.Fatalf("Unexpected tcp service %+v expected %+v", tcp, svc1.Name)
@@ -194,3 +213,318 @@ func TestGetServices(t *testing.T) {
 		}
 	}
 }
+
+func TestGetServicesAllNamespaces(t *testing.T) {
+	endpointAddresses := []api.EndpointAddress{
+		{IP: "1.2.3.4"},
+	}
+	endpointPorts := []api.EndpointPort{
+		{Port: 80, Protocol: "TCP"},
+	}
+	servicePorts := []api.ServicePort{
+		{Port: 80, TargetPort: util.NewIntOrStringFromInt(80)},
+	}
+
+	// The same service in 3 namespaces, one of which is excluded.
+	svcs := []*api.Service{}
+	endpoints := []*api.Endpoints{}
+	for _, namespace := range []string{ns, "foo", "bar"} {
+		svc := getService(servicePorts)
+		svc.Name = "web"
+		svc.Namespace = namespace
+		svcs = append(svcs, svc)
+		endpoints = append(endpoints, getEndpoints(svc, endpointAddresses, endpointPorts))
+	}
+	flb := newFakeLoadBalancerController(endpoints, svcs)
+	flb.allNamespaces = true
+	flb.excludeNamespaces = util.NewStringSet("bar")
+
+	http, _, _ := flb.getServices()
+	expectedPaths := map[string]string{
+		"web":     "/web",
+		"foo_web": "/foo/web",
+	}
+	if len(http) != len(expectedPaths) {
+		t.Fatalf("Expected %d http services, got %+v", len(expectedPaths), http)
+	}
+	for _, s := range http {
+		path, ok := expectedPaths[s.Name]
+		if !ok || path != s.Path {
+			t.Fatalf("Unexpected http service %+v, expected one of %+v", s, expectedPaths)
+		}
+	}
+	// Longer paths must be matched first.
+	if http[0].Path != "/foo/web" {
+		t.Fatalf("Expected namespace qualified service first, got %+v", http)
+	}
+
+	flb.includeNamespaces = util.NewStringSet("foo")
+	http, _, _ = flb.getServices()
+	if len(http) != 1 || http[0].Name != "foo_web" {
+		t.Fatalf("Expected only the service in namespace foo, got %+v", http)
+	}
+}
+
+func TestGetServicesHostRouting(t *testing.T) {
+	endpointAddresses := []api.EndpointAddress{
+		{IP: "1.2.3.4"},
+	}
+	endpointPorts := []api.EndpointPort{
+		{Port: 80, Protocol: "TCP"},
+	}
+	servicePorts := []api.ServicePort{
+		{Port: 80, TargetPort: util.NewIntOrStringFromInt(80)},
+	}
+
+	plain := getService(servicePorts)
+	plain.Name = "plain"
+	byHost := getService(servicePorts)
+	byHost.Annotations = map[string]string{lbHostKey: "API.example.com, invalid_host"}
+	byHostAndPath := getService(servicePorts)
+	byHostAndPath.Annotations = map[string]string{lbHostKey: "www.example.com", lbPathKey: "/static"}
+	byPath := getService(servicePorts)
+	byPath.Annotations = map[string]string{lbPathKey: "/custom/path"}
+	svcs := []*api.Service{plain, byHost, byHostAndPath, byPath}
+	endpoints := []*api.Endpoints{}
+	for _, svc := range svcs {
+		endpoints = append(endpoints, getEndpoints(svc, endpointAddresses, endpointPorts))
+	}
+	flb := newFakeLoadBalancerController(endpoints, svcs)
+
+	http, _, _ := flb.getServices()
+	if len(http) != len(svcs) {
+		t.Fatalf("Expected %d http services, got %+v", len(svcs), http)
+	}
+	expected := []struct {
+		name  string
+		hosts []string
+		path  string
+	}{
+		{byHostAndPath.Name, []string{"www.example.com"}, "/static"},
+		{byHost.Name, []string{"api.example.com"}, "/"},
+		{byPath.Name, nil, "/custom/path"},
+		{plain.Name, nil, "/" + plain.Name},
+	}
+	for i, e := range expected {
+		s := http[i]
+		if s.Name != e.name || s.Path != e.path || !reflect.DeepEqual(s.Hosts, e.hosts) {
+			t.Errorf("Expected route %d to be %+v, got %+v", i, e, s)
+		}
+	}
+}
+
+func TestGetServicesRouteConflicts(t *testing.T) {
+	endpointAddresses := []api.EndpointAddress{
+		{IP: "1.2.3.4"},
+	}
+	endpointPorts := []api.EndpointPort{
+		{Port: 80, Protocol: "TCP"},
+	}
+	servicePorts := []api.ServicePort{
+		{Port: 80, TargetPort: util.NewIntOrStringFromInt(80)},
+	}
+
+	routes := []struct {
+		name        string
+		annotations map[string]string
+		path        string
+		rejected    bool
+	}{
+		{"a", map[string]string{lbHostKey: "www.example.com"}, "/", false},
+		{"b", map[string]string{lbHostKey: "api.example.com,www.example.com"}, "", true},
+		{"c", map[string]string{lbPathKey: "/shared"}, "/shared", false},
+		{"d", map[string]string{lbPathKey: "/shared"}, "", true},
+		{"e", map[string]string{lbPathKey: "/e(.*)"}, "/e", false},
+		{"f", map[string]string{lbPathKey: "/e"}, "", true},
+	}
+	svcs := []*api.Service{}
+	endpoints := []*api.Endpoints{}
+	for _, r := range routes {
+		svc := getService(servicePorts)
+		svc.Name = r.name
+		svc.Annotations = r.annotations
+		svcs = append(svcs, svc)
+		endpoints = append(endpoints, getEndpoints(svc, endpointAddresses, endpointPorts))
+	}
+	flb := newFakeLoadBalancerController(endpoints, svcs)
+
+	http, _, _ := flb.getServices()
+	paths := map[string]string{}
+	for _, svc := range http {
+		paths[svc.Name] = svc.Path
+	}
+	for _, r := range routes {
+		path, ok := paths[r.name]
+		if ok == r.rejected || path != r.path {
+			t.Errorf("Expected %v to route %q (rejected %v), got %q", r.name, r.path, r.rejected, path)
+		}
+		status := flb.statuses["default/"+r.name]
+		if rejected := len(status.Ports) == 1 && status.Ports[0].Reason != ""; rejected != r.rejected {
+			t.Errorf("Expected %v to be rejected %v, got status %+v", r.name, r.rejected, status.Ports)
+		}
+	}
+	conflicts := 0
+	for _, event := range flb.recorder.(*fakeEventRecorder).events {
+		if strings.HasPrefix(event, routeConflictReason) {
+			conflicts++
+		}
+	}
+	if conflicts != 3 {
+		t.Errorf("Expected 3 %v events, got %v", routeConflictReason, flb.recorder.(*fakeEventRecorder).events)
+	}
+}
+
+// newTestConfig returns a haproxy config in dir, with a template listing the
+// names of the http services.
+func newTestConfig(t *testing.T, dir, validateCmd string) *loadBalancerConfig {
+	tmpl := filepath.Join(dir, "template.cfg")
+	if err := ioutil.WriteFile(tmpl, []byte("{{range .httpServices}}{{.Name}}\n{{end}}"), 0644); err != nil {
+		t.Fatalf("Unable to write template: %v", err)
+	}
+	cfg := &loadBalancerConfig{
+		Name:        "haproxy",
+		Config:      filepath.Join(dir, "lb.cfg"),
+		Template:    tmpl,
+		ValidateCmd: validateCmd,
+	}
+	var err error
+	if cfg.backend, err = newLoadBalancerBackend(cfg); err != nil {
+		t.Fatalf("Unable to create backend: %v", err)
+	}
+	return cfg
+}
+
+func TestWriteOnlyOnChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service-loadbalancer")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := newTestConfig(t, dir, "")
+	services := map[string][]service{
+		"httpServices": {{Name: "a"}, {Name: "b"}},
+	}
+	for i, expected := range []bool{true, false} {
+		changed, err := cfg.write(services, false)
+		if err != nil {
+			t.Fatalf("Unexpected error writing config: %v", err)
+		}
+		if changed != expected {
+			t.Errorf("Write %d: expected changed == %v", i, expected)
+		}
+	}
+	services["httpServices"] = []service{{Name: "a"}, {Name: "c"}}
+	if changed, err := cfg.write(services, false); err != nil || !changed {
+		t.Errorf("Expected config to change without error, got %v: %v", changed, err)
+	}
+	if contents, _ := ioutil.ReadFile(cfg.Config); string(contents) != "a\nc\n" {
+		t.Errorf("Unexpected config contents %q", string(contents))
+	}
+}
+
+func TestWriteStableOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service-loadbalancer")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmpl := filepath.Join(dir, "template.cfg")
+	if err := ioutil.WriteFile(tmpl, []byte("{{range .httpServices}}{{.Name}}\n{{end}}{{range .tcpServices}}{{.Name}}\n{{end}}"), 0644); err != nil {
+		t.Fatalf("Unable to write template: %v", err)
+	}
+	cfg := &loadBalancerConfig{
+		Name:     "haproxy",
+		Config:   filepath.Join(dir, "lb.cfg"),
+		Template: tmpl,
+	}
+	if cfg.backend, err = newLoadBalancerBackend(cfg); err != nil {
+		t.Fatalf("Unable to create backend: %v", err)
+	}
+
+	// Services with routes of the same length, and tcp services, come out
+	// of the store in any order.
+	svcs := []*api.Service{}
+	endpoints := []*api.Endpoints{}
+	for i := 0; i < 10; i++ {
+		svc := getService([]api.ServicePort{{Port: 80, TargetPort: util.NewIntOrStringFromInt(8080)}})
+		svc.Name = fmt.Sprintf("svc%d", i)
+		svcs = append(svcs, svc)
+		endpoints = append(endpoints, getEndpoints(svc, []api.EndpointAddress{{IP: "1.2.3.4"}}, []api.EndpointPort{{Port: 8080}}))
+	}
+	lbc := newFakeLoadBalancerController(endpoints, svcs)
+	lbc.tcpServices = map[string]int{"svc0": 80, "svc1": 80, "svc2": 80, "svc3": 80}
+
+	for i := 0; i < 20; i++ {
+		httpSvc, tcpSvc, _ := lbc.getServices()
+		changed, err := cfg.write(map[string][]service{"httpServices": httpSvc, "tcpServices": tcpSvc}, false)
+		if err != nil {
+			t.Fatalf("Unexpected error writing config: %v", err)
+		}
+		if changed != (i == 0) {
+			t.Fatalf("Render %d: expected changed == %v", i, i == 0)
+		}
+	}
+}
+
+func TestWriteRejectsInvalidConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service-loadbalancer")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Only configs without the bad service are valid.
+	cfg := newTestConfig(t, dir, "! grep -q bad")
+	if _, err := cfg.write(map[string][]service{"httpServices": {{Name: "good"}}}, false); err != nil {
+		t.Fatalf("Unexpected error writing config: %v", err)
+	}
+	changed, err := cfg.write(map[string][]service{"httpServices": {{Name: "bad"}}}, false)
+	if _, ok := err.(*configValidationError); !ok || changed {
+		t.Fatalf("Expected a validation error, got %v: %v", changed, err)
+	}
+	if contents, _ := ioutil.ReadFile(cfg.Config); string(contents) != "good\n" {
+		t.Errorf("Expected the last valid config to be kept, got %q", string(contents))
+	}
+	if contents, _ := ioutil.ReadFile(cfg.Config + ".rejected"); string(contents) != "bad\n" {
+		t.Errorf("Expected the rejected config to be saved, got %q", string(contents))
+	}
+
+	// Only the accepted config is applied by the next reload.
+	h := cfg.backend.(*haproxyBackend)
+	if services := h.rendered.services["httpServices"]; len(services) != 1 || services[0].Name != "good" {
+		t.Errorf("Expected the good config to be applied, got %+v", services)
+	}
+	if _, err := cfg.write(map[string][]service{"httpServices": {{Name: "dry"}}}, true); err != nil {
+		t.Fatalf("Unexpected error in a dry run: %v", err)
+	}
+	if services := h.rendered.services["httpServices"]; len(services) != 1 || services[0].Name != "good" {
+		t.Errorf("Expected the good config to be applied after a dry run, got %+v", services)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	diff := diffLines("a\nb\nc\n", "a\nc\nd\n")
+	if diff != "-b\n+d\n" {
+		t.Errorf("Unexpected diff %q", diff)
+	}
+	if diff := diffLines("a\n", "a\n"); diff != "" {
+		t.Errorf("Expected empty diff, got %q", diff)
+	}
+
+	// Large configs that differ in a few lines are diffed, configs that
+	// differ everywhere are summarized.
+	a, b := []string{}, []string{}
+	for i := 0; i < 5000; i++ {
+		a = append(a, fmt.Sprintf("a%v", i))
+		b = append(b, fmt.Sprintf("b%v", i))
+	}
+	changed := append(append([]string{}, a...), "c")
+	if diff := diffLines(strings.Join(a, "\n"), strings.Join(changed, "\n")); diff != "+c\n" {
+		t.Errorf("Unexpected diff %q", diff)
+	}
+	if diff := diffLines(strings.Join(a, "\n"), strings.Join(b, "\n")); diff != "5000 lines replaced by 5000 lines, too many to diff\n" {
+		t.Errorf("Unexpected diff %q", diff)
+	}
+}
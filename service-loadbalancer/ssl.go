@@ -0,0 +1,179 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+const (
+	// lbSslSecretKey is the service annotation naming a secret, in the same
+	// namespace as the service, that holds the certificate and key used to
+	// terminate ssl for the service.
+	lbSslSecretKey = "serviceloadbalancer/lb.ssl-secret"
+
+	// sslCertKey and sslKeyKey are the keys of the pem encoded certificate
+	// and private key in the secret.
+	sslCertKey = "tls.crt"
+	sslKeyKey  = "tls.key"
+
+	// certDirName is the directory, next to the loadbalancer config, that
+	// holds the certificate bundles.
+	certDirName = "certs"
+
+	// invalidCertificateReason is the reason of events about services whose
+	// ssl secret can't be used.
+	invalidCertificateReason = "InvalidCertificate"
+)
+
+// getSslSecret returns the namespace/name key of the secret referenced by the
+// lbSslSecretKey annotation of the given service, or "" if it has none.
+func getSslSecret(s *api.Service) string {
+	name := strings.TrimSpace(s.Annotations[lbSslSecretKey])
+	if name == "" {
+		return ""
+	}
+	return fmt.Sprintf("%v/%v", s.Namespace, name)
+}
+
+// certDir returns the directory certificate bundles are written to.
+func (cfg *loadBalancerConfig) certDir() string {
+	return filepath.Join(filepath.Dir(cfg.Config), certDirName)
+}
+
+// certPath returns the path of the bundle for the secret with the given key.
+// Bundles are named after their contents, so a new certificate never replaces
+// the bundle the running config uses, and changes the config instead.
+func (cfg *loadBalancerConfig) certPath(secretKey string, bundle []byte) string {
+	name := fmt.Sprintf("%v-%x.pem", strings.Replace(secretKey, "/", "_", -1), sha256.Sum256(bundle))
+	return filepath.Join(cfg.certDir(), name)
+}
+
+// getCertBundle concatenates the certificate and key of a secret, which is the
+// format haproxy expects for the crt option. The certificate and key must be
+// a valid pair.
+func getCertBundle(secret *api.Secret) ([]byte, error) {
+	cert, ok := secret.Data[sslCertKey]
+	if !ok || len(cert) == 0 {
+		return nil, fmt.Errorf("secret %v/%v has no %v", secret.Namespace, secret.Name, sslCertKey)
+	}
+	key, ok := secret.Data[sslKeyKey]
+	if !ok || len(key) == 0 {
+		return nil, fmt.Errorf("secret %v/%v has no %v", secret.Namespace, secret.Name, sslKeyKey)
+	}
+	if _, err := tls.X509KeyPair(cert, key); err != nil {
+		return nil, fmt.Errorf("secret %v/%v has an invalid certificate and key: %v", secret.Namespace, secret.Name, err)
+	}
+	bundle := append([]byte{}, cert...)
+	if !bytes.HasSuffix(bundle, []byte("\n")) {
+		bundle = append(bundle, '\n')
+	}
+	return append(bundle, key...), nil
+}
+
+// getSecretBundle returns the certificate bundle of the secret with the given
+// key.
+func (lbc *loadBalancerController) getSecretBundle(secretKey string) ([]byte, error) {
+	obj, exists, err := lbc.secretStore.GetByKey(secretKey)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("secret %v not found", secretKey)
+	}
+	return getCertBundle(obj.(*api.Secret))
+}
+
+// checkSslSecret returns true if the secret with the given key holds a valid
+// certificate and key for the service. Otherwise the service is only served
+// over http, which is reported with an event.
+func (lbc *loadBalancerController) checkSslSecret(s *api.Service, secretKey string) bool {
+	if _, err := lbc.getSecretBundle(secretKey); err != nil {
+		glog.Errorf("Serving %v/%v over http only: %v", s.Namespace, s.Name, err)
+		lbc.eventf(s, invalidCertificateReason, "Serving over http only: %v", err)
+		return false
+	}
+	return true
+}
+
+// syncCerts writes the certificate bundles of all http services that terminate
+// ssl to disk, and returns the services to expose on the https frontend along
+// with the bundles they use. Services whose secret has gone since
+// checkSslSecret are only served over http. Bundles of the running config are
+// left alone, see removeStaleCerts. If dryRun is true nothing is written to
+// disk.
+func (lbc *loadBalancerController) syncCerts(httpSvc []service, dryRun bool) (httpsSvc []service, inUse util.StringSet, err error) {
+	if !dryRun {
+		if err := os.MkdirAll(lbc.cfg.certDir(), 0700); err != nil {
+			return nil, nil, err
+		}
+	}
+	inUse = util.NewStringSet()
+	for _, s := range httpSvc {
+		if s.sslSecret == "" {
+			continue
+		}
+		bundle, err := lbc.getSecretBundle(s.sslSecret)
+		if err != nil {
+			glog.Errorf("Serving %v over http only: %v", s.Name, err)
+			continue
+		}
+		certPath := lbc.cfg.certPath(s.sslSecret, bundle)
+		if !dryRun && !inUse.Has(certPath) {
+			if written, err := writeFileIfChanged(certPath, bundle, 0600); err != nil {
+				return nil, nil, err
+			} else if written {
+				glog.Infof("Wrote certificate bundle %v for secret %v", certPath, s.sslSecret)
+			}
+		}
+		inUse.Insert(certPath)
+		s.SslCert = certPath
+		s.FrontendPort = lbc.httpsPort
+		httpsSvc = append(httpsSvc, s)
+	}
+	return
+}
+
+// removeStaleCerts removes the bundles that aren't in use. It must only be
+// called once the config using them has been accepted, since the running
+// config may still use the others.
+func (lbc *loadBalancerController) removeStaleCerts(inUse util.StringSet) error {
+	stale, err := filepath.Glob(filepath.Join(lbc.cfg.certDir(), "*.pem"))
+	if err != nil {
+		return err
+	}
+	for _, certPath := range stale {
+		if inUse.Has(certPath) {
+			continue
+		}
+		glog.Infof("Removing unused certificate bundle %v", certPath)
+		if err := os.Remove(certPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
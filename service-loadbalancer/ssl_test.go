@@ -0,0 +1,184 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/cache"
+)
+
+// newTestCertificate returns a pem encoded self signed certificate and key.
+func newTestCertificate(t *testing.T) (cert, key []byte) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Unable to generate key: %v", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("Unable to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		t.Fatalf("Unable to encode key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func newSslSecret(name string, cert, key []byte) *api.Secret {
+	return &api.Secret{
+		ObjectMeta: api.ObjectMeta{Name: name, Namespace: ns},
+		Data: map[string][]byte{
+			sslCertKey: cert,
+			sslKeyKey:  key,
+		},
+	}
+}
+
+func TestSyncCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service-loadbalancer")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := newTestCertificate(t)
+	flb := newFakeLoadBalancerController(nil, nil)
+	flb.cfg = &loadBalancerConfig{Config: filepath.Join(dir, "haproxy.cfg")}
+	flb.httpsPort = 443
+	flb.secretStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	flb.secretStore.Add(newSslSecret("web-ssl", cert, key))
+
+	// A bundle the running config still uses.
+	if err := os.MkdirAll(flb.cfg.certDir(), 0700); err != nil {
+		t.Fatalf("Unable to create cert dir: %v", err)
+	}
+	running := flb.cfg.certPath(ns+"/old", []byte("old"))
+	if err := ioutil.WriteFile(running, []byte("old"), 0600); err != nil {
+		t.Fatalf("Unable to write running bundle: %v", err)
+	}
+
+	httpSvc := []service{
+		{Name: "web", Path: "/web", FrontendPort: 80, sslSecret: ns + "/web-ssl"},
+		{Name: "missing", Path: "/missing", FrontendPort: 80, sslSecret: ns + "/missing"},
+		{Name: "plain", Path: "/plain", FrontendPort: 80},
+	}
+	httpsSvc, inUse, err := flb.syncCerts(httpSvc, false)
+	if err != nil {
+		t.Fatalf("Unexpected error syncing certs: %v", err)
+	}
+	bundle := append(append([]byte{}, cert...), key...)
+	certPath := flb.cfg.certPath(ns+"/web-ssl", bundle)
+	if len(httpsSvc) != 1 || httpsSvc[0].Name != "web" ||
+		httpsSvc[0].SslCert != certPath || httpsSvc[0].FrontendPort != 443 {
+		t.Fatalf("Unexpected https services %+v", httpsSvc)
+	}
+	if !reflect.DeepEqual(inUse.List(), []string{certPath}) {
+		t.Errorf("Expected only %v in use, got %v", certPath, inUse.List())
+	}
+	written, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		t.Fatalf("Unable to read certificate bundle: %v", err)
+	}
+	if string(written) != string(bundle) {
+		t.Errorf("Unexpected certificate bundle %q", string(written))
+	}
+	// The running config isn't replaced yet.
+	if _, err := os.Stat(running); err != nil {
+		t.Errorf("Expected running bundle %v to be kept: %v", running, err)
+	}
+
+	// A rotated certificate gets a new bundle, next to the current one.
+	cert, key = newTestCertificate(t)
+	flb.secretStore.Update(newSslSecret("web-ssl", cert, key))
+	httpsSvc, inUse, err = flb.syncCerts(httpSvc, false)
+	if err != nil {
+		t.Fatalf("Unexpected error syncing certs: %v", err)
+	}
+	if len(httpsSvc) != 1 || httpsSvc[0].SslCert == certPath {
+		t.Fatalf("Expected a new bundle, got %+v", httpsSvc)
+	}
+	if _, err := os.Stat(certPath); err != nil {
+		t.Errorf("Expected current bundle %v to be kept: %v", certPath, err)
+	}
+
+	// Once the config is accepted, only the bundles it uses are left.
+	if err := flb.removeStaleCerts(inUse); err != nil {
+		t.Fatalf("Unexpected error removing stale certs: %v", err)
+	}
+	left, _ := filepath.Glob(filepath.Join(flb.cfg.certDir(), "*.pem"))
+	if len(left) != 1 || left[0] != httpsSvc[0].SslCert {
+		t.Errorf("Expected only %v to be left, got %v", httpsSvc[0].SslCert, left)
+	}
+}
+
+func TestCheckSslSecret(t *testing.T) {
+	cert, key := newTestCertificate(t)
+	otherCert, _ := newTestCertificate(t)
+	flb := newFakeLoadBalancerController(nil, nil)
+	flb.secretStore = cache.NewStore(cache.MetaNamespaceKeyFunc)
+	flb.secretStore.Add(newSslSecret("valid", cert, key))
+	flb.secretStore.Add(newSslSecret("no-key", cert, nil))
+	flb.secretStore.Add(newSslSecret("garbage", []byte("cert"), []byte("key")))
+	flb.secretStore.Add(newSslSecret("mismatch", otherCert, key))
+
+	tests := []struct {
+		secret string
+		valid  bool
+	}{
+		{"valid", true},
+		{"no-key", false},
+		{"garbage", false},
+		{"mismatch", false},
+		{"missing", false},
+	}
+	for _, test := range tests {
+		recorder := &fakeEventRecorder{}
+		flb.recorder = recorder
+		s := &api.Service{ObjectMeta: api.ObjectMeta{Name: "web", Namespace: ns}}
+		if valid := flb.checkSslSecret(s, ns+"/"+test.secret); valid != test.valid {
+			t.Errorf("Expected secret %v to be valid %v, got %v", test.secret, test.valid, valid)
+		}
+		if test.valid && len(recorder.events) != 0 {
+			t.Errorf("Expected no events for secret %v, got %v", test.secret, recorder.events)
+		}
+		if !test.valid && (len(recorder.events) != 1 || !strings.HasPrefix(recorder.events[0], invalidCertificateReason)) {
+			t.Errorf("Expected an %v event for secret %v, got %v", invalidCertificateReason, test.secret, recorder.events)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/api"
+)
+
+const (
+	// lbStatusKey is the service annotation the controller publishes the
+	// serviceStatus of a service on.
+	lbStatusKey = "serviceloadbalancer/status"
+
+	// loadbalancedReason is the reason of events about service ports
+	// picked up by the loadbalancer.
+	loadbalancedReason = "Loadbalanced"
+)
+
+// portStatus says where a service port is reachable through the
+// loadbalancer, or why it isn't.
+type portStatus struct {
+	Port     int          `json:"port"`
+	Protocol api.Protocol `json:"protocol"`
+	// URL is where the port is reachable, the host is left out unless
+	// the service has host routes or --external-address is set.
+	URL    string `json:"url,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// serviceStatus is the status of a service, published in the lbStatusKey
+// annotation. Reason is set if the whole service is skipped.
+type serviceStatus struct {
+	Reason string       `json:"reason,omitempty"`
+	Ports  []portStatus `json:"ports,omitempty"`
+
+	// service is the service the status is about.
+	service *api.Service
+}
+
+// getStatus returns the status of the given service in the sync in progress.
+func (lbc *loadBalancerController) getStatus(s *api.Service) *serviceStatus {
+	if lbc.statuses == nil {
+		lbc.statuses = map[string]*serviceStatus{}
+	}
+	key := fmt.Sprintf("%v/%v", s.Namespace, s.Name)
+	status, ok := lbc.statuses[key]
+	if !ok {
+		status = &serviceStatus{service: s}
+		lbc.statuses[key] = status
+	}
+	return status
+}
+
+// setSkipped records that the whole service isn't loadbalanced.
+func (lbc *loadBalancerController) setSkipped(s *api.Service, reason string) {
+	lbc.getStatus(s).Reason = reason
+}
+
+// setPortSkipped records that a port of the service isn't loadbalanced.
+func (lbc *loadBalancerController) setPortSkipped(s *api.Service, servicePort *api.ServicePort, reason string) {
+	status := lbc.getStatus(s)
+	status.Ports = append(status.Ports, portStatus{
+		Port: servicePort.Port, Protocol: protocolOrTCP(servicePort.Protocol), Reason: reason})
+}
+
+// setPortURL records where a port of the service is reachable.
+func (lbc *loadBalancerController) setPortURL(s *api.Service, port int, protocol api.Protocol, url string) {
+	status := lbc.getStatus(s)
+	status.Ports = append(status.Ports, portStatus{Port: port, Protocol: protocolOrTCP(protocol), URL: url})
+}
+
+// sortStatuses sorts the ports of each status in the order of the service
+// ports, so the published status doesn't depend on the order ports are
+// resolved in.
+func (lbc *loadBalancerController) sortStatuses() {
+	for _, status := range lbc.statuses {
+		sort.Sort(bySpecOrder{status.service, status.Ports})
+	}
+}
+
+// bySpecOrder sorts port statuses in the order of the ports of the service.
+type bySpecOrder struct {
+	s     *api.Service
+	ports []portStatus
+}
+
+func (p bySpecOrder) Len() int      { return len(p.ports) }
+func (p bySpecOrder) Swap(i, j int) { p.ports[i], p.ports[j] = p.ports[j], p.ports[i] }
+func (p bySpecOrder) Less(i, j int) bool {
+	return p.index(p.ports[i]) < p.index(p.ports[j])
+}
+
+func (p bySpecOrder) index(port portStatus) int {
+	for i, servicePort := range p.s.Spec.Ports {
+		if servicePort.Port == port.Port && protocolOrTCP(servicePort.Protocol) == port.Protocol {
+			return i
+		}
+	}
+	return len(p.s.Spec.Ports)
+}
+
+// getHTTPURL returns the url of an http service.
+func (lbc *loadBalancerController) getHTTPURL(svc *service) string {
+	host := lbc.externalAddress
+	if len(svc.Hosts) > 0 {
+		host = svc.Hosts[0]
+	}
+	if lbc.httpPort != 80 {
+		host = fmt.Sprintf("%v:%v", host, lbc.httpPort)
+	}
+	return fmt.Sprintf("http://%v%v", host, svc.Path)
+}
+
+// getL4URL returns the url of a tcp or udp service.
+func (lbc *loadBalancerController) getL4URL(protocol api.Protocol, frontendPort int) string {
+	return fmt.Sprintf("%v://%v:%v", strings.ToLower(string(protocol)), lbc.externalAddress, frontendPort)
+}
+
+// publishStatuses writes the status of each service to its lbStatusKey
+// annotation if it changed, with an event for each port that became
+// reachable at a new url.
+func (lbc *loadBalancerController) publishStatuses() {
+	for key, status := range lbc.statuses {
+		s := status.service
+		data, err := json.Marshal(status)
+		if err != nil {
+			glog.Errorf("Unable to encode the status of %v: %v", key, err)
+			continue
+		}
+		if s.Annotations[lbStatusKey] == string(data) {
+			continue
+		}
+		if err := lbc.annotateService(s.Namespace, s.Name, lbStatusKey, string(data)); err != nil {
+			glog.Errorf("Unable to publish the status of %v: %v", key, err)
+			continue
+		}
+		published := map[string]bool{}
+		var previous serviceStatus
+		if err := json.Unmarshal([]byte(s.Annotations[lbStatusKey]), &previous); err == nil {
+			for _, p := range previous.Ports {
+				published[p.URL] = true
+			}
+		}
+		for _, p := range status.Ports {
+			if p.URL != "" && !published[p.URL] {
+				lbc.recorder.Eventf(s, loadbalancedReason, "Port %v is reachable at %v", p.Port, p.URL)
+			}
+		}
+	}
+}
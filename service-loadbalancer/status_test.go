@@ -0,0 +1,104 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/client/testclient"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+func TestServiceStatus(t *testing.T) {
+	web := getService([]api.ServicePort{
+		{Port: 80, TargetPort: util.NewIntOrStringFromInt(8080)},
+		{Port: 53, TargetPort: util.NewIntOrStringFromInt(53), Protocol: api.ProtocolUDP},
+		{Port: 81, TargetPort: util.NewIntOrStringFromInt(8081)},
+	})
+	web.Name = "web"
+	mysql := getService([]api.ServicePort{{Port: 3306, TargetPort: util.NewIntOrStringFromInt(3306)}})
+	mysql.Name = "mysql"
+	cloud := getService([]api.ServicePort{{Port: 80, TargetPort: util.NewIntOrStringFromInt(8080)}})
+	cloud.Name = "cloud"
+	cloud.Spec.Type = api.ServiceTypeLoadBalancer
+
+	addresses := []api.EndpointAddress{{IP: "1.2.3.4"}}
+	endpoints := []*api.Endpoints{
+		getEndpoints(web, addresses, []api.EndpointPort{{Port: 8080}, {Port: 53, Protocol: api.ProtocolUDP}}),
+		getEndpoints(mysql, addresses, []api.EndpointPort{{Port: 3306}}),
+		getEndpoints(cloud, addresses, []api.EndpointPort{{Port: 8080}}),
+	}
+	flb := newFakeLoadBalancerController(endpoints, []*api.Service{web, mysql, cloud})
+	flb.tcpServices = map[string]int{"mysql": 3306}
+	flb.externalAddress = "10.0.0.10"
+	flb.getServices()
+
+	expected := map[string]serviceStatus{
+		"web": {Ports: []portStatus{
+			{Port: 80, Protocol: api.ProtocolTCP, URL: "http://10.0.0.10/web"},
+			{Port: 53, Protocol: api.ProtocolUDP, Reason: "udp port not in --udp-services"},
+			{Port: 81, Protocol: api.ProtocolTCP, Reason: "no endpoints"},
+		}},
+		"mysql": {Ports: []portStatus{
+			{Port: 3306, Protocol: api.ProtocolTCP, URL: "tcp://10.0.0.10:3306"},
+		}},
+		"cloud": {Reason: "service has a cloud loadbalancer"},
+	}
+	statuses := map[string]serviceStatus{}
+	for _, status := range flb.statuses {
+		statuses[status.service.Name] = serviceStatus{Reason: status.Reason, Ports: status.Ports}
+	}
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Expected statuses %+v, got %+v", expected, statuses)
+	}
+
+	// The fake client can't tell services apart, so only publish web.
+	publishWeb := func() *testclient.Fake {
+		fake := testclient.NewSimpleFake(web)
+		flb.svcClient = fake
+		flb.statuses = map[string]*serviceStatus{ns + "/web": flb.statuses[ns+"/web"]}
+		flb.recorder = &fakeEventRecorder{}
+		flb.publishStatuses()
+		return fake
+	}
+	fake := publishWeb()
+	data, _ := json.Marshal(expected["web"])
+	for _, action := range fake.Actions() {
+		if update, ok := action.(testclient.UpdateAction); ok {
+			if status := update.GetObject().(*api.Service).Annotations[lbStatusKey]; status != string(data) {
+				t.Errorf("Expected status %v, got %v", string(data), status)
+			}
+		}
+	}
+	if events := flb.recorder.(*fakeEventRecorder).events; len(events) != 1 {
+		t.Errorf("Expected an event for port 80, got %v", events)
+	}
+
+	// Nothing is written, and no events are recorded, until the status changes.
+	web.Annotations = map[string]string{lbStatusKey: string(data)}
+	flb.getServices()
+	fake = publishWeb()
+	if actions := fake.Actions(); len(actions) != 0 {
+		t.Errorf("Expected no updates, got %v", actions)
+	}
+	if events := flb.recorder.(*fakeEventRecorder).events; len(events) != 0 {
+		t.Errorf("Expected no events, got %v", events)
+	}
+}
@@ -0,0 +1,276 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+const (
+	// udpSessionTimeout is how long a udp session is kept without traffic
+	// in either direction. Replies to a client go out of the frontend port
+	// for as long as its session lives.
+	udpSessionTimeout = 60 * time.Second
+
+	// udpBufferSize fits the largest udp datagram.
+	udpBufferSize = 64 * 1024
+)
+
+// udpProxy proxies udp services. Neither haproxy nor the nginx versions we
+// ship balance udp, so the controller does it itself. Each client address
+// gets a session, pinned to an endpoint, that relays the replies of the
+// endpoint back to the client. Each frontend has at most maxSessions
+// sessions, so a flood of spoofed client addresses can't exhaust the file
+// descriptors of the controller.
+type udpProxy struct {
+	lock        sync.Mutex
+	frontends   map[int]*udpFrontend
+	idleTimeout time.Duration
+	maxSessions int
+}
+
+func newUDPProxy(idleTimeout time.Duration, maxSessions int) *udpProxy {
+	return &udpProxy{
+		frontends:   map[int]*udpFrontend{},
+		idleTimeout: idleTimeout,
+		maxSessions: maxSessions,
+	}
+}
+
+// update starts, updates and stops udp frontends so there is one for each of
+// the given services, on its FrontendPort.
+func (p *udpProxy) update(services []service) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	seen := map[int]bool{}
+	for _, svc := range services {
+		if seen[svc.FrontendPort] {
+			glog.Errorf("Ignoring udp service %v, port %v is taken", svc.Name, svc.FrontendPort)
+			continue
+		}
+		seen[svc.FrontendPort] = true
+		if f, ok := p.frontends[svc.FrontendPort]; ok {
+			f.setService(svc)
+			continue
+		}
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: svc.FrontendPort})
+		if err != nil {
+			glog.Errorf("Unable to listen on udp port %v for %v: %v", svc.FrontendPort, svc.Name, err)
+			continue
+		}
+		glog.Infof("Proxying udp port %v to %v", svc.FrontendPort, svc.Name)
+		f := &udpFrontend{
+			conn:        conn,
+			idleTimeout: p.idleTimeout,
+			maxSessions: p.maxSessions,
+			sessions:    map[string]*udpSession{},
+		}
+		f.setService(svc)
+		p.frontends[svc.FrontendPort] = f
+		go f.serve()
+	}
+	for port, f := range p.frontends {
+		if !seen[port] {
+			glog.Infof("Closing udp port %v", port)
+			f.close()
+			delete(p.frontends, port)
+		}
+	}
+}
+
+// udpFrontend balances the datagrams received on a port across the
+// endpoints of a service.
+type udpFrontend struct {
+	conn        *net.UDPConn
+	idleTimeout time.Duration
+	maxSessions int
+
+	lock     sync.Mutex
+	svc      service
+	sessions map[string]*udpSession
+	// next is the round robin position in svc.Ep.
+	next int
+}
+
+// udpSession relays the datagrams of a client to an endpoint, and back.
+type udpSession struct {
+	client   *net.UDPAddr
+	endpoint string
+	conn     *net.UDPConn
+
+	lock       sync.Mutex
+	lastActive time.Time
+}
+
+func (s *udpSession) touch() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastActive = time.Now()
+}
+
+func (s *udpSession) idle(timeout time.Duration) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return time.Since(s.lastActive) >= timeout
+}
+
+// setService points the frontend at the given service, closing sessions to
+// endpoints that are gone.
+func (f *udpFrontend) setService(svc service) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.svc = svc
+	eps := util.NewStringSet(svc.Ep...)
+	for key, s := range f.sessions {
+		if !eps.Has(s.endpoint) {
+			s.conn.Close()
+			delete(f.sessions, key)
+		}
+	}
+}
+
+// close stops the frontend and all its sessions.
+func (f *udpFrontend) close() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.conn.Close()
+	for key, s := range f.sessions {
+		s.conn.Close()
+		delete(f.sessions, key)
+	}
+}
+
+// serve relays datagrams from clients until the frontend is closed.
+func (f *udpFrontend) serve() {
+	buf := make([]byte, udpBufferSize)
+	for {
+		n, client, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Temporary() {
+				continue
+			}
+			return
+		}
+		s, err := f.getSession(client)
+		if err != nil {
+			glog.V(2).Infof("Dropping udp datagram from %v: %v", client, err)
+			continue
+		}
+		s.touch()
+		if _, err := s.conn.Write(buf[:n]); err != nil {
+			glog.V(2).Infof("Error relaying udp datagram from %v to %v: %v", client, s.endpoint, err)
+		}
+	}
+}
+
+// getSession returns the session of the given client, creating one if needed
+// and the frontend has room for it.
+func (f *udpFrontend) getSession(client *net.UDPAddr) (*udpSession, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if s, ok := f.sessions[client.String()]; ok {
+		return s, nil
+	}
+	if len(f.sessions) >= f.maxSessions {
+		return nil, fmt.Errorf("%v has %v sessions", f.svc.Name, len(f.sessions))
+	}
+	endpoint := f.pickEndpoint(client)
+	if endpoint == "" {
+		return nil, fmt.Errorf("%v has no endpoints", f.svc.Name)
+	}
+	addr, err := net.ResolveUDPAddr("udp", endpoint)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{client: client, endpoint: endpoint, conn: conn, lastActive: time.Now()}
+	f.sessions[client.String()] = s
+	go f.relayReplies(s)
+	return s, nil
+}
+
+// pickEndpoint returns the endpoint for a new session of the given client,
+// according to the algorithm of the service. Callers must hold the lock.
+func (f *udpFrontend) pickEndpoint(client *net.UDPAddr) string {
+	eps := f.svc.Ep
+	if len(eps) == 0 {
+		return ""
+	}
+	switch f.svc.Algorithm {
+	case "source":
+		h := fnv.New32a()
+		h.Write(client.IP)
+		return eps[int(h.Sum32()%uint32(len(eps)))]
+	case "leastconn":
+		sessions := map[string]int{}
+		for _, s := range f.sessions {
+			sessions[s.endpoint]++
+		}
+		least := eps[0]
+		for _, ep := range eps[1:] {
+			if sessions[ep] < sessions[least] {
+				least = ep
+			}
+		}
+		return least
+	default:
+		ep := eps[f.next%len(eps)]
+		f.next++
+		return ep
+	}
+}
+
+// relayReplies sends the replies of the endpoint of a session to its client,
+// until the session is idle or closed.
+func (f *udpFrontend) relayReplies(s *udpSession) {
+	defer f.removeSession(s)
+	buf := make([]byte, udpBufferSize)
+	for {
+		s.conn.SetReadDeadline(time.Now().Add(f.idleTimeout))
+		n, err := s.conn.Read(buf)
+		if err != nil {
+			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() && !s.idle(f.idleTimeout) {
+				continue
+			}
+			return
+		}
+		s.touch()
+		if _, err := f.conn.WriteToUDP(buf[:n], s.client); err != nil {
+			glog.V(2).Infof("Error relaying udp datagram from %v to %v: %v", s.endpoint, s.client, err)
+		}
+	}
+}
+
+// removeSession forgets the given session and closes its connection.
+func (f *udpFrontend) removeSession(s *udpSession) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.sessions[s.client.String()] == s {
+		delete(f.sessions, s.client.String())
+	}
+	s.conn.Close()
+}
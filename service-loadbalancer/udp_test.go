@@ -0,0 +1,153 @@
+/*
+Copyright 2015 The Kubernetes Authors All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"k8s.io/kubernetes/pkg/api"
+	"k8s.io/kubernetes/pkg/util"
+)
+
+// startUDPEcho starts a udp server replying to each datagram with name,
+// followed by the datagram.
+func startUDPEcho(t *testing.T, name string) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Unexpected error listening: %v", err)
+	}
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(append([]byte(name+" "), buf[:n]...), addr)
+		}
+	}()
+	return conn
+}
+
+// udpRoundTrip sends msg to the given port of localhost and returns the reply.
+func udpRoundTrip(t *testing.T, port int, msg string) string {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	if err != nil {
+		t.Fatalf("Unexpected error dialing: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatalf("Unexpected error writing: %v", err)
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Unexpected error reading the reply to %q: %v", msg, err)
+	}
+	return string(buf[:n])
+}
+
+func TestUDPProxy(t *testing.T) {
+	a, b := startUDPEcho(t, "a"), startUDPEcho(t, "b")
+	defer a.Close()
+	defer b.Close()
+
+	p := newUDPProxy(time.Minute, 10)
+	svc := service{Name: "dns:53", Ep: []string{a.LocalAddr().String()}, Algorithm: "roundrobin"}
+	p.update([]service{svc})
+	if len(p.frontends) != 1 {
+		t.Fatalf("Expected a frontend, got %+v", p.frontends)
+	}
+	port := p.frontends[0].conn.LocalAddr().(*net.UDPAddr).Port
+
+	if reply := udpRoundTrip(t, port, "ping"); reply != "a ping" {
+		t.Errorf("Expected a reply from a, got %q", reply)
+	}
+
+	// Sessions to removed endpoints are closed, new sessions go to the new
+	// endpoints.
+	svc.Ep = []string{b.LocalAddr().String()}
+	p.update([]service{svc})
+	f := p.frontends[0]
+	f.lock.Lock()
+	if len(f.sessions) != 0 {
+		t.Errorf("Expected the session to a to be closed, got %+v", f.sessions)
+	}
+	f.lock.Unlock()
+	if reply := udpRoundTrip(t, port, "ping"); reply != "b ping" {
+		t.Errorf("Expected a reply from b, got %q", reply)
+	}
+
+	p.update(nil)
+	if len(p.frontends) != 0 {
+		t.Errorf("Expected the frontend to be closed, got %+v", p.frontends)
+	}
+}
+
+func TestUDPProxySessionLimit(t *testing.T) {
+	a := startUDPEcho(t, "a")
+	defer a.Close()
+
+	p := newUDPProxy(time.Minute, 1)
+	svc := service{Name: "dns:53", Ep: []string{a.LocalAddr().String()}, Algorithm: "roundrobin"}
+	p.update([]service{svc})
+	defer p.update(nil)
+	f := p.frontends[0]
+
+	first, err := f.getSession(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error creating a session: %v", err)
+	}
+	if _, err := f.getSession(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}); err == nil {
+		t.Errorf("Expected a second client to be dropped")
+	}
+	if s, err := f.getSession(first.client); err != nil || s != first {
+		t.Errorf("Expected the first client to keep its session, got %+v: %v", s, err)
+	}
+
+	// Clients get a session again once one times out.
+	f.removeSession(first)
+	if _, err := f.getSession(&net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2}); err != nil {
+		t.Errorf("Unexpected error creating a session after one was removed: %v", err)
+	}
+}
+
+func TestGetServicesUDP(t *testing.T) {
+	svc := getService([]api.ServicePort{
+		{Name: "dns", Port: 53, TargetPort: util.NewIntOrStringFromInt(53), Protocol: api.ProtocolUDP},
+		{Name: "dns-tcp", Port: 53, TargetPort: util.NewIntOrStringFromInt(53), Protocol: api.ProtocolTCP},
+		{Name: "syslog", Port: 514, TargetPort: util.NewIntOrStringFromInt(514), Protocol: api.ProtocolUDP},
+	})
+	endpoints := []*api.Endpoints{getEndpoints(svc, []api.EndpointAddress{{IP: "1.2.3.4"}}, []api.EndpointPort{
+		{Name: "dns", Port: 53, Protocol: api.ProtocolUDP},
+		{Name: "dns-tcp", Port: 53, Protocol: api.ProtocolTCP},
+		{Name: "syslog", Port: 514, Protocol: api.ProtocolUDP},
+	})}
+	flb := newFakeLoadBalancerController(endpoints, []*api.Service{svc})
+	flb.udpServices = map[string]int{svc.Name: 53}
+
+	http, tcp, udp := flb.getServices()
+	if len(udp) != 1 || udp[0].FrontendPort != 53 || len(udp[0].Ep) != 1 || udp[0].Ep[0] != "1.2.3.4:53" {
+		t.Errorf("Expected the dns port as a udp service, got %+v", udp)
+	}
+	if len(http) != 1 || len(tcp) != 0 {
+		t.Errorf("Expected only the tcp dns port as an http service, got %+v and %+v", http, tcp)
+	}
+}